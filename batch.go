@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxBatchSlots bounds how many slots one /badges-batch request can ask for.
+const maxBatchSlots = 20
+
+// parseBatchSlots parses the comma-separated slots parameter of
+// /badges-batch. Every entry must be a slot number of at least 1.
+func parseBatchSlots(slotsStr string) ([]string, []int, error) {
+	if slotsStr == "" {
+		return nil, nil, fmt.Errorf("slots is required, such as slots=1,2,3")
+	}
+	raw := strings.Split(slotsStr, ",")
+	if len(raw) > maxBatchSlots {
+		return nil, nil, fmt.Errorf("at most %d slots can be requested at once", maxBatchSlots)
+	}
+	slots := make([]int, len(raw))
+	for i, entry := range raw {
+		raw[i] = strings.TrimSpace(entry)
+		slot, err := strconv.Atoi(raw[i])
+		if err != nil || slot < 1 {
+			return nil, nil, fmt.Errorf("invalid slot %q in slots parameter", entry)
+		}
+		slots[i] = slot
+	}
+	return raw, slots, nil
+}
+
+const defaultMaxBatchBytes = 32 << 20
+
+// maxBatchBytes, from MAX_BATCH_BYTES, bounds the total size of the badges
+// one /badges-batch response carries. withServeTimeout holds the response in
+// memory until the handler returns, however it is written.
+var maxBatchBytes int64 = defaultMaxBatchBytes
+
+func resolveMaxBatchBytes() int64 {
+	value := strings.TrimSpace(os.Getenv("MAX_BATCH_BYTES"))
+	if value == "" {
+		return defaultMaxBatchBytes
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		slog.Warn("invalid MAX_BATCH_BYTES, using default", "value", value, "default", defaultMaxBatchBytes)
+		return defaultMaxBatchBytes
+	}
+	return limit
+}
+
+// batchHandler serves /badges-batch?slots=1,2,3, the badges those slots
+// select, as /badge.gif would select them, in one multipart/mixed response.
+// The boundary is random per response and given in the Content-Type header's
+// boundary parameter, as usual for multipart. Each part, in the order of
+// slots, carries:
+//
+//	Content-Type: the badge's content type
+//	Content-Disposition: inline; filename=<badge filename>, quoted if needed
+//	X-Slot: the slot it was selected for
+//
+// group, format, seed, key and ns apply to every slot as they do for
+// /badge.gif. Image processing parameters are not supported. Batches whose
+// badges total more than maxBatchBytes get 413.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	rawSlots, slots, err := parseBatchSlots(r.URL.Query().Get("slots"))
+	if err != nil {
+		badgeErrorsTotal.inc("invalid_slots")
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	baseSeed, err := resolveSeed(r.URL.Query())
+	if err != nil {
+		badgeErrorsTotal.inc("invalid_seed")
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rediscoverIfStale()
+	snapshot := snapshotBadges()
+	if len(snapshot.files) == 0 {
+		badgeErrorsTotal.inc("no_badges")
+		rediscoverIfEmpty()
+		writeError(w, r, "No badges available", http.StatusNotFound)
+		return
+	}
+	if len(snapshot.files) < minBadges {
+		serveTooFewBadges(w, r, len(snapshot.files))
+		return
+	}
+	format := r.URL.Query().Get("format")
+	pool := snapshot.candidates(r.URL.Query().Get("group"), "")
+	count := len(narrowToFormat(pool, format))
+	for _, slot := range rawSlots {
+		if err := checkStrictSlot(slot, count); err != nil {
+			badgeErrorsTotal.inc("invalid_slot")
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if rotationMode == "session" && !hasExplicitSeed(r.URL.Query()) {
+		baseSeed = advanceSession(w, r)
+	}
+
+	// Every badge is located, and the batch's size checked, before anything
+	// is written, so those failures still get a proper error response.
+	badges := make([]locatedBadge, len(slots))
+	names := make([]string, len(slots))
+	var total int64
+	for i, slot := range slots {
+		badge, ok := locateChosenBadge(w, r, pool, count, func(pool []string) (string, error) {
+			return snapshot.pick(pool, format, baseSeed, slot)
+		})
+		if !ok {
+			return
+		}
+		badges[i], names[i] = badge, badge.name
+		total += max(badge.size, 0)
+	}
+	if total > maxBatchBytes {
+		requestLog(r).Warn("badge batch too large", "bytes", total, "limit", maxBatchBytes)
+		badgeErrorsTotal.inc("batch_too_large")
+		writeError(w, r, fmt.Sprintf("Badges total %d bytes, over the %d byte batch limit", total, maxBatchBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	noteServedBadge(r, strings.Join(names, ","))
+
+	// Each part is read and written in turn rather than building the body
+	// first. Remote badges have no size until they are read, so the limit is
+	// checked again as they are. Once a part is written a failure can only
+	// cut the response short, and the missing closing boundary tells the
+	// client it is incomplete.
+	parts := multipart.NewWriter(w)
+	var written int64
+	for i, badge := range badges {
+		data, err := readBadge(badge.name, badge.path, badge.modTime)
+		written += int64(len(data))
+		if err == nil && written > maxBatchBytes {
+			err = fmt.Errorf("badge batch over the %d byte limit", maxBatchBytes)
+		}
+		if err != nil {
+			requestLog(r).Error("could not read badge", "filename", badge.name, "error", err)
+			badgeErrorsTotal.inc("read_error")
+			if i == 0 {
+				writeError(w, r, "Error reading badge", http.StatusInternalServerError)
+			}
+			return
+		}
+		if i == 0 {
+			setRotationTimingHeaders(w, r)
+			setRotationCacheHeaders(w)
+			w.Header().Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": parts.Boundary()}))
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", servedContentType(badge.name, detectContentType(badge.name, data)))
+		header.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": path.Base(badge.name)}))
+		header.Set("X-Slot", strconv.Itoa(slots[i]))
+		part, err := parts.CreatePart(header)
+		if err == nil {
+			_, err = part.Write(data)
+		}
+		if err != nil {
+			requestLog(r).Warn("could not write badge batch", "error", err)
+			return
+		}
+		recordServe(badge.name)
+	}
+	if err := parts.Close(); err != nil {
+		requestLog(r).Warn("could not write badge batch", "error", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseBatchSlots(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{"1,2,3", []int{1, 2, 3}, false},
+		{" 4 , 1 ", []int{4, 1}, false},
+		{"2,2", []int{2, 2}, false},
+		{"", nil, true},
+		{"1,,2", nil, true},
+		{"0", nil, true},
+		{"1,-2", nil, true},
+		{"1,two", nil, true},
+		{strings.Repeat("1,", maxBatchSlots) + "1", nil, true},
+	} {
+		_, slots, err := parseBatchSlots(tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseBatchSlots(%q) error = %v, want error %v", tc.value, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !slices.Equal(slots, tc.want) {
+			t.Errorf("parseBatchSlots(%q) = %v, want %v", tc.value, slots, tc.want)
+		}
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	files := map[string][]byte{
+		"a.gif":          testGIF(t, 2, 2, 1),
+		"b.png":          testPNG(t, 3, 3),
+		"winter day.gif": testGIF(t, 4, 4, 2),
+	}
+	useBadges(t, files)
+
+	w := get(t, batchHandler, "/badges-batch?slots=3,1,2&seed=11")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" || params["boundary"] == "" {
+		t.Fatalf("Content-Type = %q, want multipart/mixed with a boundary", w.Header().Get("Content-Type"))
+	}
+
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	for _, slot := range []int{3, 1, 2} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("part for slot %d: %v", slot, err)
+		}
+		if got := part.Header.Get("X-Slot"); got != strconv.Itoa(slot) {
+			t.Errorf("X-Slot = %s, want %d", got, slot)
+		}
+		single := get(t, newBadgeHandler(""), "/badge.gif?seed=11&slot="+strconv.Itoa(slot))
+		body, _ := io.ReadAll(part)
+		if !bytes.Equal(body, single.Body.Bytes()) {
+			t.Errorf("slot %d: part differs from /badge.gif for the same slot", slot)
+		}
+		if got, want := part.Header.Get("Content-Type"), single.Header().Get("Content-Type"); got != want {
+			t.Errorf("slot %d: part Content-Type = %q, want %q", slot, got, want)
+		}
+		_, disposition, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if err != nil {
+			t.Fatalf("slot %d: Content-Disposition %q: %v", slot, part.Header.Get("Content-Disposition"), err)
+		}
+		if data, ok := files[disposition["filename"]]; !ok || !bytes.Equal(data, body) {
+			t.Errorf("slot %d: filename %q does not name the part's badge", slot, disposition["filename"])
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("after the last slot: %v, want io.EOF", err)
+	}
+}
+
+func TestBatchHandlerErrors(t *testing.T) {
+	setForTest(t, &servePlaceholder, false)
+	useBadges(t, nil)
+	if w := get(t, batchHandler, "/badges-batch?slots=1"); w.Code != http.StatusNotFound {
+		t.Errorf("no badges: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	for _, target := range []string{
+		"/badges-batch",
+		"/badges-batch?slots=1,x",
+		"/badges-batch?slots=1&seed=x",
+	} {
+		if w := get(t, batchHandler, target); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+	setForTest(t, &minBadges, 2)
+	if w := get(t, batchHandler, "/badges-batch?slots=1"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("with too few badges: status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	minBadges = 0
+	setForTest(t, &maxBatchBytes, int64(len(testGIF(t, 2, 2, 1))))
+	if w := get(t, batchHandler, "/badges-batch?slots=1,1"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("over maxBatchBytes: status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if w := get(t, batchHandler, "/badges-batch?slots=1"); w.Code != http.StatusOK {
+		t.Errorf("at maxBatchBytes: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	setForTest(t, &strictSlot, true)
+	if w := get(t, batchHandler, "/badges-batch?slots=1,2"); w.Code != http.StatusBadRequest {
+		t.Errorf("STRICT_SLOT with slot 2 of 1 badge: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestBatchHandlerSkipsRemovedBadges(t *testing.T) {
+	kept := testGIF(t, 3, 3, 1)
+	dir := useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 2, 2, 1), "c.gif": kept})
+	for _, name := range []string{"a.gif", "b.gif"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := get(t, batchHandler, "/badges-batch?slots=1,2,3&seed=5")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	_, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	for slot := 1; slot <= 3; slot++ {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("part for slot %d: %v", slot, err)
+		}
+		if body, _ := io.ReadAll(part); !bytes.Equal(body, kept) {
+			t.Errorf("slot %d: part is not the badge left", slot)
+		}
+	}
+	waitForDiscovery()
+}
+
+func TestResolveMaxBatchBytes(t *testing.T) {
+	for value, want := range map[string]int64{"": defaultMaxBatchBytes, "1048576": 1 << 20, "0": defaultMaxBatchBytes, "-5": defaultMaxBatchBytes, "big": defaultMaxBatchBytes} {
+		t.Setenv("MAX_BATCH_BYTES", value)
+		if got := resolveMaxBatchBytes(); got != want {
+			t.Errorf("MAX_BATCH_BYTES=%q gave %d, want %d", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultBadgeCacheMaxBytes = 64 << 20
+
+type cachedBadge struct {
+	filename string
+	data     []byte
+	modTime  time.Time
+}
+
+// badgeCache holds the bytes of served badges so popular badges aren't
+// re-read or reprocessed on every request. Entries are keyed by filename, or
+// by filename plus a variant suffix for processed copies, and are dropped
+// when the file's modtime changes. Entries that would push the cache past
+// maxBytes are not stored.
+type badgeCache struct {
+	mu       sync.Mutex
+	entries  map[string]cachedBadge
+	size     int64
+	maxBytes int64
+}
+
+func newBadgeCache(maxBytes int64) *badgeCache {
+	return &badgeCache{entries: make(map[string]cachedBadge), maxBytes: maxBytes}
+}
+
+// load returns the cached bytes for key, calling read on a miss or when
+// modTime no longer matches the cached copy. filename is the badge the entry
+// derives from, used by prune.
+func (c *badgeCache) load(key, filename string, modTime time.Time, read func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && entry.modTime.Equal(modTime) {
+		c.mu.Unlock()
+		return entry.data, nil
+	}
+	c.mu.Unlock()
+
+	data, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+	if c.size+int64(len(data)) <= c.maxBytes {
+		c.entries[key] = cachedBadge{filename: filename, data: data, modTime: modTime}
+		c.size += int64(len(data))
+	}
+	return data, nil
+}
+
+// prune drops entries for files that are no longer discovered or whose
+// modtime differs from the one seen during discovery.
+func (c *badgeCache) prune(modTimes map[string]time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if modTime, ok := modTimes[entry.filename]; !ok || !modTime.Equal(entry.modTime) {
+			c.removeLocked(key)
+		}
+	}
+}
+
+func (c *badgeCache) removeLocked(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.size -= int64(len(entry.data))
+		delete(c.entries, key)
+	}
+}
+
+// diskCache keeps processed badge variants in dir, so resized or recoded
+// copies survive restarts and cold starts. Each file holds the badge's
+// modtime in Unix nanoseconds followed by the variant's bytes, and is named
+// by a hash of the badge's filename and a hash of its cache key, so prune
+// can find a badge's files without reading them. Files written past
+// maxBytes evict the least recently used ones.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+	// failed is set after the first failed write, which is logged; later
+	// writes are skipped.
+	failed atomic.Bool
+
+	mu sync.Mutex
+	// files maps the name of every file in dir to its size and last use,
+	// seeded from the directory's modtimes when the cache is opened.
+	files map[string]diskEntry
+	size  int64
+}
+
+type diskEntry struct {
+	size int64
+	used time.Time
+}
+
+// diskBadges is nil, caching in memory only, when BADGE_CACHE=0 or the cache
+// directory isn't writable.
+var diskBadges *diskCache
+
+// resolveDiskCache picks the cache directory: CACHE_DIR when set, otherwise
+// a directory under /tmp on Vercel, whose filesystem is read-only elsewhere,
+// or under os.TempDir. It returns nil, logging why, when the directory can't
+// be created or written to. The files already in it count towards maxBytes.
+func resolveDiskCache(maxBytes int64) *diskCache {
+	dir := strings.TrimSpace(os.Getenv("CACHE_DIR"))
+	if dir == "" {
+		base := os.TempDir()
+		if os.Getenv("VERCEL") == "1" {
+			base = "/tmp"
+		}
+		dir = filepath.Join(base, "badge-rotator-cache")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Warn("cache directory is not usable, caching in memory only", "dir", dir, "error", err)
+		return nil
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		slog.Warn("cache directory is not writable, caching in memory only", "dir", dir, "error", err)
+		return nil
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return openDiskCache(dir, maxBytes)
+}
+
+// openDiskCache indexes the entries already in dir, evicting the oldest
+// when they exceed maxBytes.
+func openDiskCache(dir string, maxBytes int64) *diskCache {
+	d := &diskCache{dir: dir, maxBytes: maxBytes, files: make(map[string]diskEntry)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Warn("could not list cache directory", "dir", dir, "error", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		d.files[entry.Name()] = diskEntry{size: info.Size(), used: info.ModTime()}
+		d.size += info.Size()
+	}
+	d.mu.Lock()
+	d.evictLocked()
+	d.mu.Unlock()
+	return d
+}
+
+func hashName(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// diskCacheName returns the name of key's file, prefixed by the hash of
+// filename, the badge it derives from.
+func diskCacheName(key, filename string) string {
+	return hashName(filename)[:16] + "-" + hashName(key)
+}
+
+// load returns the bytes stored for key if they were written for modTime,
+// and otherwise calls read and stores its result. filename is the badge the
+// entry derives from, used by prune.
+func (d *diskCache) load(key, filename string, modTime time.Time, read func() ([]byte, error)) ([]byte, error) {
+	name := diskCacheName(key, filename)
+	if stored, err := os.ReadFile(filepath.Join(d.dir, name)); err == nil && len(stored) >= 8 && int64(binary.BigEndian.Uint64(stored)) == modTime.UnixNano() {
+		d.mu.Lock()
+		if entry, ok := d.files[name]; ok {
+			entry.used = time.Now()
+			d.files[name] = entry
+		}
+		d.mu.Unlock()
+		return stored[8:], nil
+	}
+	data, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if !d.failed.Load() && int64(len(data))+8 <= d.maxBytes {
+		if err := d.store(name, modTime, data); err != nil && !d.failed.Swap(true) {
+			slog.Warn("could not write to cache directory, caching in memory only", "dir", d.dir, "error", err)
+		}
+	}
+	return data, nil
+}
+
+// prune deletes the files of badges missing from modTimes, those the last
+// discovery dropped.
+func (d *diskCache) prune(modTimes map[string]time.Time) {
+	keep := make(map[string]bool, len(modTimes))
+	for filename := range modTimes {
+		keep[hashName(filename)[:16]] = true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name := range d.files {
+		if prefix, _, ok := strings.Cut(name, "-"); !ok || !keep[prefix] {
+			d.removeLocked(name)
+		}
+	}
+}
+
+// evictLocked deletes the least recently used files until the cache fits
+// in maxBytes.
+func (d *diskCache) evictLocked() {
+	for d.size > d.maxBytes && len(d.files) > 0 {
+		var oldest string
+		for name, entry := range d.files {
+			if oldest == "" || entry.used.Before(d.files[oldest].used) {
+				oldest = name
+			}
+		}
+		d.removeLocked(oldest)
+	}
+}
+
+func (d *diskCache) removeLocked(name string) {
+	if entry, ok := d.files[name]; ok {
+		if err := os.Remove(filepath.Join(d.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("could not remove cached badge", "dir", d.dir, "error", err)
+		}
+		d.size -= entry.size
+		delete(d.files, name)
+	}
+}
+
+// store writes data to the file name through a temporary file, so readers
+// never see a partial entry, then evicts older files past maxBytes.
+func (d *diskCache) store(name string, modTime time.Time, data []byte) error {
+	tmp, err := os.CreateTemp(d.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	header := binary.BigEndian.AppendUint64(nil, uint64(modTime.UnixNano()))
+	if _, err := tmp.Write(append(header, data...)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(d.dir, name)); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if entry, ok := d.files[name]; ok {
+		d.size -= entry.size
+	}
+	size := int64(len(header) + len(data))
+	d.files[name] = diskEntry{size: size, used: time.Now()}
+	d.size += size
+	d.evictLocked()
+	return nil
+}
+
+// loadVariant returns the processed badge stored under key, from badgeBytes
+// and then diskBadges, calling read when neither has a copy for modTime.
+func loadVariant(key, filename string, modTime time.Time, read func() ([]byte, error)) ([]byte, error) {
+	if diskBadges != nil {
+		readFromDisk := read
+		read = func() ([]byte, error) {
+			return diskBadges.load(key, filename, modTime, readFromDisk)
+		}
+	}
+	if badgeBytes == nil {
+		return read()
+	}
+	return badgeBytes.load(key, filename, modTime, read)
+}
+
+// readBadge returns the raw bytes of filename at path, in badgeFS or a remote
+// URL, from badgeBytes when caching is enabled.
+func readBadge(filename, path string, modTime time.Time) ([]byte, error) {
+	read := func() ([]byte, error) {
+		if isRemoteBadgePath(path) {
+			return fetchRemote(path)
+		}
+		return fs.ReadFile(badgeFS, path)
+	}
+	if badgeBytes == nil {
+		return read()
+	}
+	return badgeBytes.load(filename, filename, modTime, read)
+}
+
+// processedBadge returns the badge bytes after applying variant, a
+// processing step keyed by name such as "delay=5". Results are cached in
+// badgeBytes alongside the raw file, and in diskBadges, when caching is
+// enabled.
+func processedBadge(filename, path string, modTime time.Time, variant string, process func([]byte) ([]byte, error)) ([]byte, error) {
+	read := func() ([]byte, error) {
+		raw, err := readBadge(filename, path, modTime)
+		if err != nil {
+			return nil, err
+		}
+		return process(raw)
+	}
+	return loadVariant(filename+"#"+variant, filename, modTime, read)
+}
+
+// gzippedBadge returns data, the badge filename as processed by variant,
+// gzip-compressed. The result is cached like processed badges.
+func gzippedBadge(filename string, modTime time.Time, variant string, data []byte) ([]byte, error) {
+	compress := func() ([]byte, error) {
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return loadVariant(filename+"#"+variant+";gzip", filename, modTime, compress)
+}
+
+// preloadBadges reads every discovered badge into badgeBytes, along with the
+// processed copy served when a request asks for no processing of its own,
+// so the first requests don't pay for a cold read and decode. Badges that
+// fail to process are cached raw, as they would be served.
+func preloadBadges() {
+	if badgeBytes == nil {
+		slog.Warn("PRELOAD needs the badge cache, skipping preload")
+		return
+	}
+	start := time.Now()
+	preloaded := 0
+	for _, name := range snapshotBadges().files {
+		badge, err := locateBadge(name)
+		if err != nil {
+			slog.Warn("could not preload badge", "filename", name, "error", err)
+			continue
+		}
+		variant, process, _ := badgeProcessing(name, url.Values{})
+		if process == nil {
+			_, err = readBadge(name, badge.path, badge.modTime)
+		} else {
+			_, err = processedBadge(name, badge.path, badge.modTime, variant, process)
+		}
+		if err != nil {
+			slog.Warn("could not preload badge", "filename", name, "error", err)
+			continue
+		}
+		preloaded++
+	}
+	badgeBytes.mu.Lock()
+	cached := badgeBytes.size
+	badgeBytes.mu.Unlock()
+	slog.Info("preloaded badges", "count", preloaded, "cachedBytes", cached, "duration", time.Since(start).String())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingRead returns a read func for data and the count of its calls.
+func countingRead(data []byte) (func() ([]byte, error), *int) {
+	calls := 0
+	return func() ([]byte, error) {
+		calls++
+		return data, nil
+	}, &calls
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	d := openDiskCache(dir, 250)
+	modTime := time.Unix(1700000000, 0)
+	payload := bytes.Repeat([]byte{1}, 92) // 100 bytes with the modtime header
+
+	for _, name := range []string{"a.gif", "b.gif"} {
+		read, _ := countingRead(payload)
+		if _, err := d.load(name+"#w=2", name, modTime, read); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Use a.gif again so b.gif is the least recently used.
+	read, calls := countingRead(payload)
+	if _, err := d.load("a.gif#w=2", "a.gif", modTime, read); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 0 {
+		t.Fatal("a.gif was read again instead of coming from disk")
+	}
+	read, _ = countingRead(payload)
+	if _, err := d.load("c.gif#w=2", "c.gif", modTime, read); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.size > d.maxBytes {
+		t.Errorf("cache holds %d bytes, want at most %d", d.size, d.maxBytes)
+	}
+	for name, wantCached := range map[string]bool{"a.gif": true, "b.gif": false, "c.gif": true} {
+		_, err := os.Stat(filepath.Join(dir, diskCacheName(name+"#w=2", name)))
+		if cached := err == nil; cached != wantCached {
+			t.Errorf("%s on disk = %v, want %v", name, cached, wantCached)
+		}
+	}
+}
+
+func TestDiskCacheSkipsEntriesOverBudget(t *testing.T) {
+	dir := t.TempDir()
+	d := openDiskCache(dir, 50)
+	read, _ := countingRead(bytes.Repeat([]byte{1}, 100))
+	if _, err := d.load("a.gif#w=2", "a.gif", time.Unix(1, 0), read); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("cache directory holds %d files, want none", len(entries))
+	}
+}
+
+func TestDiskCacheOpenEnforcesBudget(t *testing.T) {
+	dir := t.TempDir()
+	for i, name := range []string{"old", "new"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		used := time.Now().Add(time.Duration(i-2) * time.Hour)
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := openDiskCache(dir, 150)
+	if _, err := os.Stat(filepath.Join(dir, "old")); err == nil {
+		t.Error("the older file survived opening a cache over budget")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); err != nil {
+		t.Errorf("the newer file was evicted: %v", err)
+	}
+	if d.size != 100 {
+		t.Errorf("cache size = %d, want 100", d.size)
+	}
+}
+
+func TestDiskCachePruneDropsUndiscoveredBadges(t *testing.T) {
+	dir := t.TempDir()
+	d := openDiskCache(dir, 1<<20)
+	modTime := time.Unix(1700000000, 0)
+	for _, key := range []string{"a.gif#w=2", "a.gif#w=2;gzip", "b.gif#w=2"} {
+		read, _ := countingRead([]byte("data"))
+		filename, _, _ := strings.Cut(key, "#")
+		if _, err := d.load(key, filename, modTime, read); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.prune(map[string]time.Time{"a.gif": modTime})
+
+	for key, want := range map[string]bool{"a.gif#w=2": true, "a.gif#w=2;gzip": true, "b.gif#w=2": false} {
+		filename, _, _ := strings.Cut(key, "#")
+		_, err := os.Stat(filepath.Join(dir, diskCacheName(key, filename)))
+		if cached := err == nil; cached != want {
+			t.Errorf("%s on disk after prune = %v, want %v", key, cached, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultMaxDataURIBytes = 64 << 10
+
+// maxDataURIBytes, from MAX_DATAURI_BYTES, is the largest badge
+// /badge.datauri encodes. Base64 grows it by a third, and a data URI that
+// size is already unwieldy in a page.
+var maxDataURIBytes int64 = defaultMaxDataURIBytes
+
+func resolveMaxDataURIBytes() int64 {
+	value := strings.TrimSpace(os.Getenv("MAX_DATAURI_BYTES"))
+	if value == "" {
+		return defaultMaxDataURIBytes
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		slog.Warn("invalid MAX_DATAURI_BYTES, using default", "value", value, "default", defaultMaxDataURIBytes)
+		return defaultMaxDataURIBytes
+	}
+	return limit
+}
+
+// dataURIHandler serves /badge.datauri, the badge /badge.gif would serve for
+// the same slot, group, format, seed, key, ns and name parameters, as a
+// base64 data URI in a text/plain body, for inlining into generated HTML or
+// SVG. Badges over maxDataURIBytes get 413.
+func dataURIHandler(w http.ResponseWriter, r *http.Request) {
+	sel, ok := selectForPreview(w, r, true)
+	if !ok {
+		return
+	}
+	badge, ok := locateChosenBadge(w, r, sel.pool, sel.attempts, sel.choose)
+	if !ok {
+		return
+	}
+	noteServedBadge(r, badge.name)
+	// An oversized badge is refused before it is read. A remote badge's size
+	// is only known once it is read, so it is checked again after.
+	if badge.size > maxDataURIBytes {
+		serveDataURITooLarge(w, r, badge.name, badge.size)
+		return
+	}
+	data, err := readBadge(badge.name, badge.path, badge.modTime)
+	if err != nil {
+		requestLog(r).Error("could not read badge", "filename", badge.name, "error", err)
+		badgeErrorsTotal.inc("read_error")
+		writeError(w, r, "Error reading badge", http.StatusInternalServerError)
+		return
+	}
+	if int64(len(data)) > maxDataURIBytes {
+		serveDataURITooLarge(w, r, badge.name, int64(len(data)))
+		return
+	}
+
+	// Data URIs take media type parameters without the space after ";".
+	contentType := strings.ReplaceAll(servedContentType(badge.name, detectContentType(badge.name, data)), "; ", ";")
+	setRotationTimingHeaders(w, r)
+	setRotationCacheHeaders(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	recordServe(badge.name)
+	fmt.Fprintf(w, "data:%s;base64,%s", contentType, base64.StdEncoding.EncodeToString(data))
+}
+
+// serveDataURITooLarge answers with a 413 for a badge of size bytes, over
+// maxDataURIBytes.
+func serveDataURITooLarge(w http.ResponseWriter, r *http.Request, name string, size int64) {
+	requestLog(r).Warn("badge too large for a data URI", "filename", name, "bytes", size, "limit", maxDataURIBytes)
+	badgeErrorsTotal.inc("datauri_too_large")
+	writeError(w, r, fmt.Sprintf("Badge is %d bytes, over the %d byte data URI limit", size, maxDataURIBytes), http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// decodeDataURI splits a base64 data URI into its media type and bytes.
+func decodeDataURI(t testing.TB, uri string) (string, []byte) {
+	t.Helper()
+	rest, ok := strings.CutPrefix(uri, "data:")
+	if !ok {
+		t.Fatalf("%.40q is not a data URI", uri)
+	}
+	mediaType, encoded, ok := strings.Cut(rest, ";base64,")
+	if !ok {
+		t.Fatalf("%.40q is not a base64 data URI", uri)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mediaType, data
+}
+
+func TestDataURIRoundTrip(t *testing.T) {
+	files := map[string][]byte{
+		"a.gif": testGIF(t, 4, 4, 2),
+		"b.png": testPNG(t, 3, 3),
+		"c.svg": []byte(testSVG),
+	}
+	useBadges(t, files)
+	for _, tc := range []struct {
+		query, mediaType, file string
+	}{
+		{"format=gif", "image/gif", "a.gif"},
+		{"format=png", "image/png", "b.png"},
+		{"format=svg", "image/svg+xml;charset=utf-8", "c.svg"},
+	} {
+		w := get(t, dataURIHandler, "/badge.datauri?slot=1&"+tc.query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d: %s", tc.query, w.Code, http.StatusOK, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Errorf("%s: Content-Type = %q, want text/plain", tc.query, ct)
+		}
+		mediaType, data := decodeDataURI(t, w.Body.String())
+		if mediaType != tc.mediaType {
+			t.Errorf("%s: media type = %q, want %q", tc.query, mediaType, tc.mediaType)
+		}
+		if !bytes.Equal(data, files[tc.file]) {
+			t.Errorf("%s: decoded data differs from %s", tc.query, tc.file)
+		}
+	}
+}
+
+func TestDataURIMatchesBadge(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 3, 3, 1), "c.gif": testGIF(t, 4, 4, 1)})
+	for _, slot := range []string{"1", "2", "3"} {
+		badge := get(t, newBadgeHandler(""), "/badge.gif?seed=5&slot="+slot)
+		_, data := decodeDataURI(t, get(t, dataURIHandler, "/badge.datauri?seed=5&slot="+slot).Body.String())
+		if !bytes.Equal(data, badge.Body.Bytes()) {
+			t.Errorf("slot %s: data URI and /badge.gif serve different badges", slot)
+		}
+	}
+}
+
+func TestDataURILimit(t *testing.T) {
+	data := testGIF(t, 4, 4, 1)
+	useBadges(t, map[string][]byte{"a.gif": data})
+	for _, tc := range []struct {
+		limit int64
+		want  int
+	}{
+		{int64(len(data)) - 1, http.StatusRequestEntityTooLarge},
+		{int64(len(data)), http.StatusOK},
+		{int64(len(data)) + 1, http.StatusOK},
+	} {
+		setForTest(t, &maxDataURIBytes, tc.limit)
+		if w := get(t, dataURIHandler, "/badge.datauri?slot=1"); w.Code != tc.want {
+			t.Errorf("limit %d for a %d byte badge: status = %d, want %d", tc.limit, len(data), w.Code, tc.want)
+		}
+	}
+}
+
+func TestResolveMaxDataURIBytes(t *testing.T) {
+	for value, want := range map[string]int64{"": defaultMaxDataURIBytes, "1024": 1024, "0": defaultMaxDataURIBytes, "-5": defaultMaxDataURIBytes, "big": defaultMaxDataURIBytes} {
+		t.Setenv("MAX_DATAURI_BYTES", value)
+		if got := resolveMaxDataURIBytes(); got != want {
+			t.Errorf("MAX_DATAURI_BYTES=%q gave %d, want %d", value, got, want)
+		}
+	}
+}
+
+// unreadableFS is a StatFS whose files can be stat'ed but not opened, so a
+// test can tell whether a badge was read.
+type unreadableFS struct {
+	fs.StatFS
+}
+
+func (unreadableFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+}
+
+func TestDataURILimitCheckedBeforeReading(t *testing.T) {
+	data := testGIF(t, 4, 4, 1)
+	dir := useBadges(t, map[string][]byte{"a.gif": data})
+	badgeFS = unreadableFS{os.DirFS(dir).(fs.StatFS)}
+	setForTest(t, &maxDataURIBytes, int64(len(data))-1)
+	if w := get(t, dataURIHandler, "/badge.datauri?slot=1"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d without reading the badge", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestPreviewSelectsLikeBadge(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 3, 3, 1), "c.gif": testGIF(t, 4, 4, 1)})
+
+	setForTest(t, &minBadges, 4)
+	for _, handler := range []http.HandlerFunc{previewHandler, badgeMetaHandler, dataURIHandler} {
+		if w := get(t, handler, "/preview?slot=1"); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("with too few badges: status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+		}
+	}
+	minBadges = 0
+
+	setForTest(t, &rotationMode, "session")
+	setForTest(t, &newStrategy, rotationModes["session"])
+	withCookie := func(target string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "7"})
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	badge := withCookie("/badge.gif", newBadgeHandler(""))
+	var preview previewResponse
+	w := withCookie("/preview", previewHandler)
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("/preview advanced the session: Set-Cookie %q", w.Header().Get("Set-Cookie"))
+	}
+	dataURI := withCookie("/badge.datauri", dataURIHandler)
+	if got, want := dataURI.Header().Get("Set-Cookie"), badge.Header().Get("Set-Cookie"); got != want {
+		t.Errorf("/badge.datauri Set-Cookie = %q, want %q as /badge.gif sets", got, want)
+	}
+	if _, data := decodeDataURI(t, dataURI.Body.String()); !bytes.Equal(data, badge.Body.Bytes()) {
+		t.Error("/badge.datauri and /badge.gif serve different badges for the same session")
+	}
+	if got := get(t, fileBadgeRoute(), "/badge/"+preview.Filename).Body.Bytes(); !bytes.Equal(got, badge.Body.Bytes()) {
+		t.Errorf("/preview reports %s, not the badge /badge.gif serves for the same session", preview.Filename)
+	}
+}
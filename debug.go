@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxDebugSlots = 100
+
+// debugEndpoints reports whether the /debug/ handlers are registered. They
+// are on unless DEBUG_ENDPOINTS=0.
+var debugEndpoints = true
+
+// debugDelay, from DEBUG_DELAY, holds every badge response back this long so
+// embed clients can be tried against a slow server. Zero adds no delay.
+var debugDelay time.Duration
+
+func resolveDebugDelay() time.Duration {
+	value := strings.TrimSpace(os.Getenv("DEBUG_DELAY"))
+	if value == "" {
+		return 0
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil || delay < 0 {
+		slog.Warn("invalid DEBUG_DELAY, serving without delay", "value", value)
+		return 0
+	}
+	return delay
+}
+
+// waitDebugDelay sleeps for debugDelay, returning false when r's client goes
+// away first.
+func waitDebugDelay(r *http.Request) bool {
+	if debugDelay == 0 {
+		return true
+	}
+	timer := time.NewTimer(debugDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+type debugSlotsResponse struct {
+	Seed                   int64             `json:"seed"`
+	SecondsUntilNextWindow int64             `json:"secondsUntilNextWindow"`
+	Slots                  map[string]string `json:"slots"`
+}
+
+// debugSlotsHandler serves /debug/slots, the badge every slot from 1 to count
+// shows for the current rotation window, selected exactly as /badge.gif
+// would select it. count defaults to the number of candidate badges.
+func debugSlotsHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot := snapshotBadges()
+	if len(snapshot.files) == 0 {
+		writeError(w, r, "No badges available", http.StatusNotFound)
+		return
+	}
+	baseSeed, err := resolveSeed(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	pool := snapshot.candidates(r.URL.Query().Get("group"), "")
+	candidates := narrowToFormat(pool, format)
+
+	count := min(len(candidates), maxDebugSlots)
+	if countStr := r.URL.Query().Get("count"); countStr != "" {
+		parsed, err := strconv.Atoi(countStr)
+		if err != nil || parsed < 1 || parsed > maxDebugSlots {
+			writeError(w, r, fmt.Sprintf("count must be between 1 and %d", maxDebugSlots), http.StatusBadRequest)
+			return
+		}
+		count = parsed
+	}
+
+	slots := make(map[string]string, count)
+	for slot := 1; slot <= count; slot++ {
+		name, err := snapshot.pick(pool, format, baseSeed, slot)
+		if err != nil {
+			requestLog(r).Error("could not select badge", "slot", slot, "seed", baseSeed, "error", err)
+			writeError(w, r, "Error selecting badge", http.StatusInternalServerError)
+			return
+		}
+		slots[strconv.Itoa(slot)] = name
+	}
+
+	body, err := json.Marshal(debugSlotsResponse{
+		Seed:                   baseSeed,
+		SecondsUntilNextWindow: secondsUntilNextWindow(),
+		Slots:                  slots,
+	})
+	if err != nil {
+		requestLog(r).Error("could not encode slot assignments", "error", err)
+		writeError(w, r, "Error encoding slot assignments", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+}
+
+type debugDiscoveryResponse struct {
+	Source            string         `json:"source"`
+	Badges            int            `json:"badges"`
+	LastDiscoveryTime time.Time      `json:"lastDiscoveryTime"`
+	Skipped           []skippedBadge `json:"skipped"`
+}
+
+// debugDiscoveryHandler serves /debug/discovery, the files the last
+// discovery left out of rotation and why, such as an unsupported extension
+// or EXCLUDE_PATTERN. Badges dropped since, for failing to decode or through
+// /disable, are listed too.
+func debugDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	response := debugDiscoveryResponse{
+		Source:            badgeSource(),
+		Badges:            len(currentBadgeFiles()),
+		LastDiscoveryTime: lastDiscoveryTime,
+		Skipped:           append([]skippedBadge{}, discoverySkipped...),
+	}
+	mu.Unlock()
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		requestLog(r).Error("could not encode discovery report", "error", err)
+		writeError(w, r, "Error encoding discovery report", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+}
+
+func resolveDebugEndpoints() bool {
+	return os.Getenv("DEBUG_ENDPOINTS") != "0"
+}
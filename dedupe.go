@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// dedupeBadges, set by DEDUPE=1, has discovery keep one filename per unique
+// file content, so a badge committed twice isn't served twice as often.
+var dedupeBadges bool
+
+type contentHash struct {
+	modTime time.Time
+	sum     [sha256.Size]byte
+}
+
+// contentHashes caches each local badge's content hash by modtime, so
+// repeated discoveries only read files that changed. Only discovery touches
+// it, and discoveries run one at a time.
+var contentHashes = make(map[string]contentHash)
+
+// hashBadge returns the SHA-256 of the local badge name, from contentHashes
+// while its modtime is unchanged.
+func hashBadge(name string, modTime time.Time) ([sha256.Size]byte, error) {
+	if cached, ok := contentHashes[name]; ok && cached.modTime.Equal(modTime) {
+		return cached.sum, nil
+	}
+	f, err := badgeFS.Open(name)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	contentHashes[name] = contentHash{modTime: modTime, sum: sum}
+	return sum, nil
+}
+
+// dedupeByContent drops badges whose content duplicates another's, keeping
+// the alphabetically first name of each, and returns the rest in their
+// original order along with the dropped badges and why. Badges that can't
+// be hashed are kept. Cache entries for badges no longer listed are
+// dropped.
+func dedupeByContent(names []string, modTimes map[string]time.Time) ([]string, []skippedBadge) {
+	for name := range contentHashes {
+		if _, ok := modTimes[name]; !ok {
+			delete(contentHashes, name)
+		}
+	}
+	firstWith := make(map[[sha256.Size]byte]string)
+	duplicateOf := make(map[string]string)
+	for _, name := range slices.Sorted(slices.Values(names)) {
+		sum, err := hashBadge(name, modTimes[name])
+		if err != nil {
+			slog.Warn("could not hash badge for DEDUPE, keeping it", "filename", name, "error", err)
+			continue
+		}
+		if first, ok := firstWith[sum]; ok {
+			duplicateOf[name] = first
+			continue
+		}
+		firstWith[sum] = name
+	}
+	if len(duplicateOf) == 0 {
+		return names, nil
+	}
+	var skipped []skippedBadge
+	kept := slices.DeleteFunc(names, func(name string) bool {
+		first, ok := duplicateOf[name]
+		if ok {
+			skipped = append(skipped, skippedBadge{Name: name, Reason: "duplicate of " + first})
+		}
+		return ok
+	})
+	return kept, skipped
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDedupeKeepsFirstName(t *testing.T) {
+	setForTest(t, &dedupeBadges, true)
+	setForTest(t, &contentHashes, make(map[string]contentHash))
+	same := testGIF(t, 2, 2, 1)
+	useBadges(t, map[string][]byte{
+		"b.gif":        same,
+		"seasonal.gif": testGIF(t, 3, 3, 1),
+		"a.gif":        same,
+		"z/copy.gif":   same,
+	})
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"a.gif", "seasonal.gif"}) {
+		t.Errorf("discovered %v, want [a.gif seasonal.gif]", files)
+	}
+	mu.Lock()
+	skipped := discoverySkipped
+	mu.Unlock()
+	for _, name := range []string{"b.gif", "z/copy.gif"} {
+		if !slices.Contains(skipped, skippedBadge{Name: name, Reason: "duplicate of a.gif"}) {
+			t.Errorf("%s is not listed as a duplicate of a.gif: %v", name, skipped)
+		}
+	}
+}
+
+func TestDedupeOffKeepsDuplicates(t *testing.T) {
+	setForTest(t, &dedupeBadges, false)
+	same := testGIF(t, 2, 2, 1)
+	useBadges(t, map[string][]byte{"a.gif": same, "b.gif": same})
+	if files := currentBadgeFiles(); len(files) != 2 {
+		t.Errorf("discovered %v, want both without DEDUPE", files)
+	}
+}
+
+func TestDedupeHashesOnlyChangedFiles(t *testing.T) {
+	setForTest(t, &dedupeBadges, true)
+	setForTest(t, &contentHashes, make(map[string]contentHash))
+	dir := useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 3, 3, 1)})
+	first := contentHashes["b.gif"]
+
+	// Same modtime, different content: the cached hash is trusted.
+	path := filepath.Join(dir, "b.gif")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, testGIF(t, 4, 4, 1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	resetDiscovery()
+	discoverBadges()
+	if contentHashes["b.gif"] != first {
+		t.Error("b.gif was hashed again although its modtime is unchanged")
+	}
+
+	// A new modtime is hashed again, and removed badges leave the cache.
+	later := info.ModTime().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "a.gif")); err != nil {
+		t.Fatal(err)
+	}
+	resetDiscovery()
+	discoverBadges()
+	if contentHashes["b.gif"].sum == first.sum {
+		t.Error("b.gif was not hashed again after its modtime changed")
+	}
+	if _, ok := contentHashes["a.gif"]; ok {
+		t.Error("the removed a.gif is still in the hash cache")
+	}
+}
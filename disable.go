@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	disabledFileName = "disabled.json"
+	disabledReason   = "disabled through /disable"
+)
+
+// disabledBadges holds the badges pulled from rotation through /disable,
+// guarded by mu. Discovery leaves them out until /enable restores them.
+var disabledBadges = make(map[string]bool)
+
+// disabledFile is where disabledBadges is persisted, CACHE_DIR's
+// disabled.json, or "" to keep it in memory only when CACHE_DIR is unset.
+var disabledFile string
+
+// resolveDisabledFile returns the path disabledBadges is persisted to.
+func resolveDisabledFile() string {
+	dir := strings.TrimSpace(os.Getenv("CACHE_DIR"))
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, disabledFileName)
+}
+
+// loadDisabled reads the badges disabled before a restart from disabledFile.
+func loadDisabled() map[string]bool {
+	disabled := make(map[string]bool)
+	if disabledFile == "" {
+		return disabled
+	}
+	data, err := os.ReadFile(disabledFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("could not read disabled badges", "file", disabledFile, "error", err)
+		}
+		return disabled
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		slog.Warn("malformed disabled badges, enabling all", "file", disabledFile, "error", err)
+		return disabled
+	}
+	for _, name := range names {
+		disabled[name] = true
+	}
+	if len(disabled) > 0 {
+		slog.Info("loaded disabled badges", "file", disabledFile, "badges", names)
+	}
+	return disabled
+}
+
+// saveDisabledMu keeps concurrent saves from writing disabledFile out of
+// order.
+var saveDisabledMu sync.Mutex
+
+// saveDisabled writes disabledBadges to disabledFile through a temporary
+// file, so a crash never leaves it half written.
+func saveDisabled() error {
+	if disabledFile == "" {
+		return nil
+	}
+	saveDisabledMu.Lock()
+	defer saveDisabledMu.Unlock()
+	mu.Lock()
+	names := disabledNamesLocked()
+	mu.Unlock()
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(disabledFile)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".disabled-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), disabledFile)
+}
+
+// isDisabled reports whether name was pulled from rotation through /disable.
+func isDisabled(name string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return disabledBadges[name]
+}
+
+// disabledNamesLocked returns disabledBadges sorted, empty rather than nil so
+// it encodes as []. The caller holds mu.
+func disabledNamesLocked() []string {
+	names := slices.AppendSeq(make([]string, 0, len(disabledBadges)), maps.Keys(disabledBadges))
+	slices.Sort(names)
+	return names
+}
+
+type disabledResponse struct {
+	Disabled []string `json:"disabled"`
+}
+
+// disableHandler serves POST /disable?file=name, taking the badge out of
+// rotation immediately, without touching badgesDir.
+func disableHandler(w http.ResponseWriter, r *http.Request) {
+	setDisabled(w, r, true)
+}
+
+// enableHandler serves POST /enable?file=name, returning a badge pulled by
+// /disable to rotation once discovery finds it again.
+func enableHandler(w http.ResponseWriter, r *http.Request) {
+	setDisabled(w, r, false)
+}
+
+func setDisabled(w http.ResponseWriter, r *http.Request, disable bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("file")
+	if err := validateBadgeFilename(name); err != nil {
+		writeError(w, r, "file must name a badge", http.StatusBadRequest)
+		return
+	}
+
+	mu.Lock()
+	if disable {
+		disabledBadges[name] = true
+		dropFromRotationLocked(name, disabledReason)
+	} else {
+		delete(disabledBadges, name)
+		// The badge's file hasn't changed, so discovery has to be told not
+		// to keep the current list.
+		discoverySignature = dirSignature{}
+	}
+	names := disabledNamesLocked()
+	mu.Unlock()
+
+	if disable {
+		requestLog(r).Info("disabled badge", "filename", name)
+	} else {
+		discoverBadgesAndWait()
+		requestLog(r).Info("enabled badge", "filename", name)
+	}
+	if err := saveDisabled(); err != nil {
+		requestLog(r).Warn("could not persist disabled badges", "file", disabledFile, "error", err)
+	}
+
+	body, err := json.Marshal(disabledResponse{Disabled: names})
+	if err != nil {
+		requestLog(r).Error("could not encode disabled badges", "error", err)
+		writeError(w, r, "Error encoding disabled badges", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
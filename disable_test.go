@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// post serves a POST of target through handler.
+func post(t testing.TB, handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, target, nil))
+	return w
+}
+
+func TestDisableAndEnable(t *testing.T) {
+	setForTest(t, &disabledFile, filepath.Join(t.TempDir(), disabledFileName))
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 2, 2, 1)})
+
+	w := post(t, disableHandler, "/disable?file=a.gif")
+	if w.Code != http.StatusOK {
+		t.Fatalf("disable: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var resp disabledResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !slices.Equal(resp.Disabled, []string{"a.gif"}) {
+		t.Errorf("disable: body = %s, want a.gif listed", w.Body)
+	}
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"b.gif"}) {
+		t.Errorf("badges after disable = %v, want [b.gif]", files)
+	}
+	for slot := 1; slot <= 4; slot++ {
+		s := snapshotBadges()
+		if name, _ := s.pick(s.candidates("", ""), "", 1, slot); name == "a.gif" {
+			t.Fatalf("slot %d selected the disabled badge", slot)
+		}
+	}
+	discoverBadges()
+	if files := currentBadgeFiles(); slices.Contains(files, "a.gif") {
+		t.Errorf("rediscovery brought back the disabled badge: %v", files)
+	}
+
+	// A restart reads the persisted list back.
+	if disabled := loadDisabled(); !disabled["a.gif"] || len(disabled) != 1 {
+		t.Errorf("persisted disabled badges = %v, want a.gif", disabled)
+	}
+
+	w = post(t, enableHandler, "/enable?file=a.gif")
+	if w.Code != http.StatusOK {
+		t.Fatalf("enable: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"a.gif", "b.gif"}) {
+		t.Errorf("badges after enable = %v, want [a.gif b.gif]", files)
+	}
+	if disabled := loadDisabled(); len(disabled) != 0 {
+		t.Errorf("persisted disabled badges after enable = %v, want none", disabled)
+	}
+}
+
+func TestDisableRejectsBadRequests(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	if w := get(t, disableHandler, "/disable?file=a.gif"); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Errorf("GET: status = %d, Allow = %q, want %d and POST", w.Code, w.Header().Get("Allow"), http.StatusMethodNotAllowed)
+	}
+	for _, target := range []string{"/disable", "/disable?file=../../etc/passwd"} {
+		if w := post(t, disableHandler, target); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"a.gif"}) {
+		t.Errorf("badges = %v, want [a.gif] untouched", files)
+	}
+}
+
+func TestDisableRequiresAdmin(t *testing.T) {
+	t.Setenv("ADMIN_USER", "admin")
+	t.Setenv("ADMIN_PASS", "secret")
+	setForTest(t, &adminCredentials, resolveAdminCredentials())
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	handler := withAdminAuth(disableHandler)
+
+	if w := post(t, handler, "/disable?file=a.gif"); w.Code != http.StatusUnauthorized {
+		t.Errorf("without credentials: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/disable?file=a.gif", nil)
+	req.SetBasicAuth("admin", "wrong")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("with a wrong password: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"a.gif"}) {
+		t.Errorf("unauthorised requests changed the badges: %v", files)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/disable?file=a.gif", nil)
+	req.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("with credentials: status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build embedbadges
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Building with -tags embedbadges compiles ./badges into the binary, so it
+// can be deployed as a single file.
+//
+//go:embed badges
+var badgesEmbed embed.FS
+
+func init() {
+	sub, err := fs.Sub(badgesEmbed, "badges")
+	if err != nil {
+		panic(err)
+	}
+	embeddedBadges = sub
+}
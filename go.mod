@@ -2,4 +2,9 @@ module github.com/MuchMeheu/go-badge-rotator
 
 go 1.24.4
 
-require golang.org/x/image v0.28.0 // indirect
+require (
+	github.com/fsnotify/fsnotify v1.10.1
+	golang.org/x/image v0.28.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// minFrameDelay is the shortest GIF frame delay, in 100ths of a second, that
+// badges are served with. Zero leaves GIFs untouched.
+var minFrameDelay int
+
+// resolveMinFrameDelay reads MIN_FRAME_DELAY_MS and converts it to the GIF
+// delay unit of 10ms, rounding up. Unset or invalid values disable clamping.
+func resolveMinFrameDelay() int {
+	value := strings.TrimSpace(os.Getenv("MIN_FRAME_DELAY_MS"))
+	if value == "" {
+		return 0
+	}
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms < 0 {
+		slog.Warn("invalid MIN_FRAME_DELAY_MS, leaving frame delays untouched", "value", value)
+		return 0
+	}
+	return (ms + 9) / 10
+}
+
+// processStep is one transformation applied to a badge's bytes. name
+// identifies its settings in cache keys and ETags.
+type processStep struct {
+	name  string
+	apply func([]byte) ([]byte, error)
+}
+
+// badgeProcessing returns the processing to apply to filename before serving,
+// as configured and requested by query, and the variant name its output is
+// cached under. It returns a nil process when the badge is served as-is and
+// an error when query asks for something invalid.
+func badgeProcessing(filename string, query url.Values) (string, func([]byte) ([]byte, error), error) {
+	var steps []processStep
+	contentType := contentTypeFor(filename)
+	static, err := parseStatic(query)
+	if err != nil {
+		return "", nil, err
+	}
+	// A static badge shows only its first frame, so steps that change how
+	// frames play are skipped.
+	static = static && contentType == "image/gif"
+	if minFrameDelay > 0 && contentType == "image/gif" && !static {
+		steps = append(steps, processStep{
+			name: fmt.Sprintf("delay=%d", minFrameDelay),
+			apply: func(data []byte) ([]byte, error) {
+				return normalizeFrameDelays(data, minFrameDelay)
+			},
+		})
+	}
+
+	width, height, err := parseResize(query)
+	if err != nil {
+		return "", nil, err
+	}
+	if width > 0 || height > 0 {
+		if contentType == "image/gif" || contentType == "image/png" {
+			steps = append(steps, processStep{
+				name: fmt.Sprintf("w=%d,h=%d", width, height),
+				apply: func(data []byte) ([]byte, error) {
+					return resizeBadge(data, contentType, width, height)
+				},
+			})
+		} else {
+			slog.Debug("resizing not supported for badge type, serving original size", "filename", filename)
+		}
+	}
+
+	if loop, err := parseLoop(query); err != nil {
+		return "", nil, err
+	} else if loop != "" && (contentType == "image/gif" || contentType == "image/png") && !static {
+		steps = append(steps, processStep{
+			name: "loop=" + loop,
+			apply: func(data []byte) ([]byte, error) {
+				return setLooping(data, contentType, loop == "infinite")
+			},
+		})
+	}
+
+	if quality, ok, err := parseQuality(query); err != nil {
+		return "", nil, err
+	} else if ok && contentType == "image/jpeg" {
+		steps = append(steps, processStep{
+			name: fmt.Sprintf("q=%d", quality),
+			apply: func(data []byte) ([]byte, error) {
+				return reencodeJPEG(data, quality)
+			},
+		})
+	}
+
+	if static {
+		steps = append(steps, processStep{name: "static", apply: firstFrame})
+	}
+
+	if len(steps) == 0 {
+		return "", nil, nil
+	}
+	names := make([]string, len(steps))
+	for i, step := range steps {
+		names[i] = step.name
+	}
+	return strings.Join(names, ";"), processOrRaw(filename, func(data []byte) ([]byte, error) {
+		for _, step := range steps {
+			var err error
+			if data, err = step.apply(data); err != nil {
+				return nil, fmt.Errorf("%s: %w", step.name, err)
+			}
+		}
+		return data, nil
+	}), nil
+}
+
+// errCorruptImage marks processing errors caused by a badge that doesn't
+// decode, as opposed to processing it doesn't support.
+var errCorruptImage = errors.New("corrupt image")
+
+// corruptImage marks a decode error with errCorruptImage when it shows the
+// data is truncated or malformed. Errors for data the decoders don't
+// support, such as arithmetic-coded JPEGs, are returned unmarked, so the
+// badge is served raw but stays in rotation.
+func corruptImage(err error) error {
+	var jpegErr jpeg.UnsupportedError
+	var pngErr png.UnsupportedError
+	if errors.Is(err, image.ErrFormat) || errors.As(err, &jpegErr) || errors.As(err, &pngErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errCorruptImage, err)
+}
+
+// processMismatches records the badges already logged as skipping
+// processing because their content doesn't match their extension.
+var processMismatches sync.Map
+
+// sniffImageType returns the supported image type data starts like, going
+// by badgeSignatures, or "" when it matches none.
+func sniffImageType(data []byte) string {
+	for contentType, matches := range badgeSignatures {
+		if matches(data) {
+			return contentType
+		}
+	}
+	return ""
+}
+
+// processOrRaw wraps process so a badge that fails to process is logged and
+// served unmodified instead of failing the request. A badge whose data is
+// truncated or malformed is also taken out of rotation.
+//
+// The steps in process were picked for the type filename's extension names,
+// so they only run on data of that type. A badge whose content is another
+// format, which detectContentType serves under its sniffed type, is served
+// raw rather than fed to the wrong decoder and taken for corrupt.
+func processOrRaw(filename string, process func([]byte) ([]byte, error)) func([]byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		if sniffed, expected := sniffImageType(data), contentTypeFor(filename); sniffed != expected {
+			if _, logged := processMismatches.LoadOrStore(filename, true); !logged {
+				slog.Warn("badge content does not match its extension, serving it unprocessed", "filename", filename, "extensionType", expected, "sniffedType", sniffed)
+			}
+			return data, nil
+		}
+		processed, err := process(data)
+		if errors.Is(err, errCorruptImage) {
+			markCorrupt(filename, err)
+			return data, nil
+		}
+		if err != nil {
+			slog.Warn("could not process badge, serving it unmodified", "filename", filename, "error", err)
+			return data, nil
+		}
+		return processed, nil
+	}
+}
+
+// normalizeFrameDelays raises every frame delay of the GIF in data to at
+// least minDelay and re-encodes it. data is returned as-is when no frame
+// needs changing.
+func normalizeFrameDelays(data []byte, minDelay int) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, corruptImage(err)
+	}
+	changed := false
+	for i, delay := range g.Delay {
+		if delay < minDelay {
+			g.Delay[i] = minDelay
+			changed = true
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+const defaultMaxResizeDimension = 1024
+
+// maxResizeDimension caps the w and h query parameters, from
+// MAX_RESIZE_DIMENSION, so clients can't request huge renders.
+var maxResizeDimension = defaultMaxResizeDimension
+
+func resolveMaxResizeDimension() int {
+	value := strings.TrimSpace(os.Getenv("MAX_RESIZE_DIMENSION"))
+	if value == "" {
+		return defaultMaxResizeDimension
+	}
+	dimension, err := strconv.Atoi(value)
+	if err != nil || dimension < 1 {
+		slog.Warn("invalid MAX_RESIZE_DIMENSION, using default", "value", value, "default", defaultMaxResizeDimension)
+		return defaultMaxResizeDimension
+	}
+	return dimension
+}
+
+// parseResize reads the w and h query parameters. Zero means the dimension
+// was not requested.
+func parseResize(query url.Values) (int, int, error) {
+	var dimensions [2]int
+	for i, key := range []string{"w", "h"} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+		dimension, err := strconv.Atoi(value)
+		if err != nil || dimension < 1 {
+			return 0, 0, fmt.Errorf("invalid %s parameter %q", key, value)
+		}
+		if dimension > maxResizeDimension {
+			return 0, 0, fmt.Errorf("%s=%d exceeds the maximum of %d", key, dimension, maxResizeDimension)
+		}
+		dimensions[i] = dimension
+	}
+	return dimensions[0], dimensions[1], nil
+}
+
+// parseQuality reads the q query parameter, the JPEG quality to re-encode at,
+// clamped to 1..100. ok is false when q is not set.
+func parseQuality(query url.Values) (quality int, ok bool, err error) {
+	value := query.Get("q")
+	if value == "" {
+		return 0, false, nil
+	}
+	quality, err = strconv.Atoi(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid q parameter %q", value)
+	}
+	return min(max(quality, 1), 100), true, nil
+}
+
+// parseStatic reads the static query parameter, "1" to serve only the first
+// frame of an animated GIF.
+func parseStatic(query url.Values) (bool, error) {
+	switch static := query.Get("static"); static {
+	case "", "0":
+		return false, nil
+	case "1":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid static parameter %q, expected 0 or 1", static)
+	}
+}
+
+// firstFrame converts an animated GIF to a PNG of its first frame, drawn on
+// the GIF's full canvas. GIFs with a single frame are returned as-is.
+func firstFrame(data []byte) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, corruptImage(err)
+	}
+	if len(g.Image) < 2 {
+		return data, nil
+	}
+	frame := g.Image[0]
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// servedName returns filename as the processed badge data is served under,
+// with a .png extension for a GIF that processing turned into a PNG, so its
+// content type and any MIME_OVERRIDES entry follow its new format.
+func servedName(filename string, data []byte) string {
+	if contentTypeFor(filename) == "image/gif" && badgeSignatures["image/png"](data) {
+		return strings.TrimSuffix(filename, path.Ext(filename)) + ".png"
+	}
+	return filename
+}
+
+// parseLoop reads the loop query parameter, "once" or "infinite", or "" when
+// it is not set.
+func parseLoop(query url.Values) (string, error) {
+	switch loop := query.Get("loop"); loop {
+	case "", "once", "infinite":
+		return loop, nil
+	default:
+		return "", fmt.Errorf("invalid loop parameter %q, expected once or infinite", loop)
+	}
+}
+
+// setLooping makes an animated GIF or APNG play forever or only once. GIFs
+// are re-encoded with or without the Netscape looping extension; APNGs have
+// the num_plays field of their acTL chunk rewritten in place. data is
+// returned as-is when it is not animated or already loops as asked.
+func setLooping(data []byte, contentType string, infinite bool) ([]byte, error) {
+	switch contentType {
+	case "image/gif":
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, corruptImage(err)
+		}
+		// image/gif uses 0 for looping forever and -1 for playing once.
+		loopCount := -1
+		if infinite {
+			loopCount = 0
+		}
+		if len(g.Image) < 2 || g.LoopCount == loopCount {
+			return data, nil
+		}
+		g.LoopCount = loopCount
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, g); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "image/png":
+		offset := findPNGChunk(data, "acTL")
+		if offset < 0 {
+			return data, nil
+		}
+		// acTL holds num_frames then num_plays, where 0 plays forever.
+		const chunkDataLen = 8
+		if binary.BigEndian.Uint32(data[offset:]) != chunkDataLen || offset+12+chunkDataLen > len(data) {
+			return nil, corruptImage(errors.New("malformed acTL chunk"))
+		}
+		var plays uint32 = 1
+		if infinite {
+			plays = 0
+		}
+		out := bytes.Clone(data)
+		binary.BigEndian.PutUint32(out[offset+12:], plays)
+		crc := crc32.ChecksumIEEE(out[offset+4 : offset+8+chunkDataLen])
+		binary.BigEndian.PutUint32(out[offset+8+chunkDataLen:], crc)
+		return out, nil
+	default:
+		return nil, fmt.Errorf("can't change looping of %s", contentType)
+	}
+}
+
+// reencodeJPEG decodes the JPEG in data and encodes it again at quality.
+// data is returned as-is when re-encoding wouldn't make it smaller.
+func reencodeJPEG(data []byte, quality int) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, corruptImage(err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// fitDimensions returns the output size for a srcW x srcH image. When only
+// one of width and height is set the other follows the source aspect ratio.
+func fitDimensions(srcW, srcH, width, height int) (int, int) {
+	switch {
+	case width > 0 && height > 0:
+		return width, height
+	case width > 0:
+		return width, max(1, srcH*width/srcW)
+	default:
+		return max(1, srcW*height/srcH), height
+	}
+}
+
+// resizeBadge scales a GIF or PNG badge to width x height. Every frame of an
+// animated GIF is scaled with nearest-neighbour sampling so the palette and
+// transparency survive; PNGs use Catmull-Rom. Animated PNGs are rejected
+// because image/png only decodes their first frame.
+func resizeBadge(data []byte, contentType string, width, height int) ([]byte, error) {
+	var buf bytes.Buffer
+	switch contentType {
+	case "image/gif":
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, corruptImage(err)
+		}
+		srcW, srcH := g.Config.Width, g.Config.Height
+		dstW, dstH := fitDimensions(srcW, srcH, width, height)
+		for i, frame := range g.Image {
+			b := frame.Bounds()
+			dstRect := image.Rect(b.Min.X*dstW/srcW, b.Min.Y*dstH/srcH, b.Max.X*dstW/srcW, b.Max.Y*dstH/srcH)
+			if dstRect.Dx() == 0 || dstRect.Dy() == 0 {
+				// Keep tiny frames at least a pixel across; the encoder
+				// rejects empty frames.
+				dstRect.Max = dstRect.Min.Add(image.Pt(max(1, dstRect.Dx()), max(1, dstRect.Dy())))
+				dstRect = dstRect.Intersect(image.Rect(0, 0, dstW, dstH))
+			}
+			scaled := image.NewPaletted(dstRect, frame.Palette)
+			draw.NearestNeighbor.Scale(scaled, dstRect, frame, b, draw.Src, nil)
+			g.Image[i] = scaled
+		}
+		g.Config.Width, g.Config.Height = dstW, dstH
+		if err := gif.EncodeAll(&buf, g); err != nil {
+			return nil, err
+		}
+	case "image/png":
+		if isAnimatedPNG(data) {
+			return nil, errors.New("animated PNGs can't be resized")
+		}
+		src, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, corruptImage(err)
+		}
+		b := src.Bounds()
+		dstW, dstH := fitDimensions(b.Dx(), b.Dy(), width, height)
+		dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+		if err := png.Encode(&buf, dst); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("can't resize %s", contentType)
+	}
+	return buf.Bytes(), nil
+}
+
+// isAnimatedPNG reports whether data is an APNG, which carries an acTL chunk
+// before its first IDAT chunk.
+func isAnimatedPNG(data []byte) bool {
+	return findPNGChunk(data, "acTL") >= 0
+}
+
+// findPNGChunk returns the offset of the first chunk of chunkType that comes
+// before the image data, or -1 when there is none.
+func findPNGChunk(data []byte, chunkType string) int {
+	const signatureLen = 8
+	for offset := signatureLen; offset+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		switch string(data[offset+4 : offset+8]) {
+		case chunkType:
+			return offset
+		case "IDAT":
+			return -1
+		}
+		offset += 12 + length
+	}
+	return -1
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMislabeledBadgeServedRaw(t *testing.T) {
+	mislabeled := testPNG(t, 4, 4)
+	useBadges(t, map[string][]byte{
+		"a.gif": mislabeled,
+		"b.gif": testGIF(t, 4, 4, 2),
+		"c.gif": testGIF(t, 4, 4, 3),
+	})
+	setForTest(t, &minFrameDelay, 5)
+
+	_, process, err := badgeProcessing("a.gif", url.Values{"w": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if process == nil {
+		t.Fatal("badgeProcessing returned no processing for a GIF with MIN_FRAME_DELAY_MS set")
+	}
+	out, err := process(mislabeled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, mislabeled) {
+		t.Error("a PNG named .gif was processed, want it served raw")
+	}
+	if files := currentBadgeFiles(); !slices.Contains(files, "a.gif") || len(files) != 3 {
+		t.Errorf("badges after processing = %v, want a.gif still in rotation", files)
+	}
+}
+
+func TestCorruptBadgeDropped(t *testing.T) {
+	corrupt := append([]byte("GIF89a"), bytes.Repeat([]byte{0xff}, 32)...)
+	useBadges(t, map[string][]byte{
+		"broken.gif": corrupt,
+		"b.gif":      testGIF(t, 4, 4, 2),
+	})
+	setForTest(t, &minFrameDelay, 5)
+
+	_, process, err := badgeProcessing("broken.gif", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := process(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, corrupt) {
+		t.Error("a corrupt badge was not served raw")
+	}
+	if files := currentBadgeFiles(); slices.Contains(files, "broken.gif") {
+		t.Errorf("badges = %v, want broken.gif dropped from rotation", files)
+	}
+}
+
+func TestUnsupportedBadgeKept(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Relabel the baseline frame as arithmetic-coded, which image/jpeg
+	// doesn't decode.
+	arithmetic := bytes.Replace(buf.Bytes(), []byte{0xff, 0xc0}, []byte{0xff, 0xc9}, 1)
+	if _, err := jpeg.Decode(bytes.NewReader(arithmetic)); !errors.As(err, new(jpeg.UnsupportedError)) {
+		t.Fatalf("decoding the test JPEG: %v, want an UnsupportedError", err)
+	}
+	useBadges(t, map[string][]byte{"a.jpg": arithmetic, "b.gif": testGIF(t, 4, 4, 2)})
+
+	_, process, err := badgeProcessing("a.jpg", url.Values{"q": {"50"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := process(arithmetic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, arithmetic) {
+		t.Error("an unsupported badge was not served raw")
+	}
+	if files := currentBadgeFiles(); !slices.Contains(files, "a.jpg") {
+		t.Errorf("badges = %v, want a.jpg still in rotation", files)
+	}
+}
+
+func TestCorruptImage(t *testing.T) {
+	for _, tc := range []struct {
+		err     error
+		corrupt bool
+	}{
+		{io.ErrUnexpectedEOF, true},
+		{jpeg.FormatError("missing SOI marker"), true},
+		{png.FormatError("invalid checksum"), true},
+		{errors.New("gif: unknown block type"), true},
+		{image.ErrFormat, false},
+		{jpeg.UnsupportedError("arithmetic coding"), false},
+		{png.UnsupportedError("bit depth"), false},
+		{fmt.Errorf("decoding: %w", image.ErrFormat), false},
+	} {
+		if got := errors.Is(corruptImage(tc.err), errCorruptImage); got != tc.corrupt {
+			t.Errorf("corruptImage(%v) marked corrupt = %v, want %v", tc.err, got, tc.corrupt)
+		}
+	}
+}
+
+func TestMinFrameDelayApplied(t *testing.T) {
+	setForTest(t, &minFrameDelay, 5)
+	_, process, err := badgeProcessing("fast.gif", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := process(testGIF(t, 4, 4, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := decodeGIF(t, out)
+	for i, delay := range g.Delay {
+		if delay < 5 {
+			t.Errorf("frame %d delay = %d, want at least 5", i, delay)
+		}
+	}
+}
+
+func TestDiscoverySkipsEmptyAndInvalidBadges(t *testing.T) {
+	gifData := testGIF(t, 4, 4, 2)
+	useBadges(t, map[string][]byte{
+		"good.gif":  gifData,
+		"empty.gif": nil,
+		"text.png":  []byte("this is not an image"),
+	})
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"good.gif"}) {
+		t.Errorf("discovered %v, want [good.gif]", files)
+	}
+	mu.Lock()
+	skipped := discoverySkipped
+	mu.Unlock()
+	for _, name := range []string{"empty.gif", "text.png"} {
+		if !slices.ContainsFunc(skipped, func(s skippedBadge) bool { return s.Name == name }) {
+			t.Errorf("%s is not listed as skipped: %v", name, skipped)
+		}
+	}
+}
+
+func TestTruncatedGIFDroppedOnResize(t *testing.T) {
+	gifData := testGIF(t, 4, 4, 2)
+	truncated := gifData[:len(gifData)/2]
+	useBadges(t, map[string][]byte{
+		"truncated.gif": truncated,
+		"good.gif":      gifData,
+	})
+	if files := currentBadgeFiles(); len(files) != 2 {
+		t.Fatalf("discovered %v, want the truncated GIF too, since its header is intact", files)
+	}
+	for range 2 {
+		get(t, newBadgeHandler(""), "/badge.gif?slot=1&seed=1&w=2")
+		get(t, newBadgeHandler(""), "/badge.gif?slot=2&seed=1&w=2")
+	}
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"good.gif"}) {
+		t.Errorf("badges after resizing = %v, want the truncated GIF dropped", files)
+	}
+	// Rediscovery leaves it out until the file changes.
+	discoverBadges()
+	if files := currentBadgeFiles(); slices.Contains(files, "truncated.gif") {
+		t.Errorf("rediscovery brought back the truncated GIF: %v", files)
+	}
+}
+
+func TestStaticFirstFrame(t *testing.T) {
+	animated := testGIF(t, 12, 7, 3)
+	useBadges(t, map[string][]byte{"animated.gif": animated, "still.gif": testGIF(t, 5, 5, 1)})
+	badgeBytes = newBadgeCache(1 << 20)
+
+	for range 2 {
+		w := get(t, fileBadgeRoute(), "/badge/animated.gif?static=1")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+			t.Errorf("Content-Type = %q, want image/png", ct)
+		}
+		img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != 12 || b.Dy() != 7 {
+			t.Errorf("first frame is %dx%d, want the source's 12x7", b.Dx(), b.Dy())
+		}
+		// The first test frame is palette index 0, black.
+		if r, g, b, a := img.At(0, 0).RGBA(); r != 0 || g != 0 || b != 0 || a != 0xffff {
+			t.Errorf("first frame pixel = %v, want opaque black", img.At(0, 0))
+		}
+	}
+
+	w := get(t, fileBadgeRoute(), "/badge/still.gif?static=1")
+	if ct := w.Header().Get("Content-Type"); ct != "image/gif" {
+		t.Errorf("single-frame GIF: Content-Type = %q, want it passed through as image/gif", ct)
+	}
+	if w := get(t, fileBadgeRoute(), "/badge/animated.gif?static=yes"); w.Code != http.StatusBadRequest {
+		t.Errorf("static=yes: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCorruptBadgeReturnsWhenFixed(t *testing.T) {
+	gifData := testGIF(t, 4, 4, 2)
+	dir := useBadges(t, map[string][]byte{
+		"a.gif": gifData[:len(gifData)/2],
+		"b.gif": gifData,
+	})
+	get(t, newBadgeHandler(""), "/badge.gif?slot=1&seed=1&w=2")
+	get(t, newBadgeHandler(""), "/badge.gif?slot=2&seed=1&w=2")
+	if slices.Contains(currentBadgeFiles(), "a.gif") {
+		t.Fatal("the truncated a.gif was not dropped")
+	}
+
+	path := filepath.Join(dir, "a.gif")
+	if err := os.WriteFile(path, gifData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	discoverBadges()
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"a.gif", "b.gif"}) {
+		t.Errorf("badges after fixing a.gif = %v, want it back in rotation", files)
+	}
+}
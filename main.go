@@ -1,161 +1,2807 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"image"
+	"io"
 	"io/fs"
-	"log"
+	"log/slog"
+	"maps"
+	"math"
 	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	// Embedded so TZ works where the system has no zoneinfo, as on Vercel.
+	_ "time/tzdata"
 )
 
 const (
-	badgesDir         = "./badges"
-	defaultPort       = "8080"
-	discoveryInterval = 5 * time.Minute
-	numBadgeSlots     = 3
+	defaultBadgesDir         = "./badges"
+	weightsFile              = "weights.json"
+	sequenceFile             = "sequence.json"
+	aliasesFile              = "aliases.json"
+	defaultPort              = "8080"
+	defaultDiscoveryInterval = 5 * time.Minute
+	defaultDiscoveryJitter   = 10
+	shutdownTimeout          = 10 * time.Second
+	// emptyRediscoverCooldown is how often requests finding no badges may
+	// trigger a discovery.
+	emptyRediscoverCooldown = 10 * time.Second
+
+	defaultRotationWindowSeconds = 2
+)
+
+// placeholderBadge is served in place of a 404 while no badges are
+// discovered, unless PLACEHOLDER_BADGE=0.
+//
+//go:embed assets/no-badges.png
+var placeholderBadge []byte
+
+// badgeContentTypes maps each supported badge extension to the Content-Type it
+// is served with. Discovery only picks up files with one of these extensions.
+// SVG badges are served as-is: they can't be resized or composited into
+// strips like raster badges.
+var badgeContentTypes = map[string]string{
+	".gif":  "image/gif",
+	".png":  "image/png",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".svg":  svgContentType,
+}
+
+const svgContentType = "image/svg+xml; charset=utf-8"
+
+// svgContentSecurityPolicy is sent with SVG badges. It allows their inline
+// styles and nothing else.
+const svgContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; sandbox"
+
+var (
+	badgesDir = defaultBadgesDir
+	// badgeFS holds the local badges: badgesDir, or the badges compiled into
+	// the binary when embeddedBadges is set. Paths of local badges are
+	// relative to it.
+	badgeFS fs.FS
+	// badgeState holds the discovered badges with the weights, sequence,
+	// aliases and metadata loaded alongside them. It is replaced wholesale,
+	// never modified, so requests load it without taking mu or copying it;
+	// writers hold mu so replacements don't race each other.
+	badgeState        atomic.Pointer[badgeSnapshot]
+	mu                sync.Mutex
+	lastDiscoveryTime time.Time
+	startTime         = time.Now()
+
+	// discovering is set while discoverBadges walks badgesDir, and
+	// rediscover asks the running walk to go again when it finishes.
+	discovering bool
+	rediscover  bool
+	// discoveryDone is closed when the running discovery finishes; it is nil
+	// while none is running.
+	discoveryDone chan struct{}
+	// discoverySkipped lists files the last discovery passed over, and why.
+	discoverySkipped []skippedBadge
+	// discoverySignature is the badgesDir signature badgeState was built
+	// from. Discovery leaves the list alone while it is unchanged.
+	discoverySignature dirSignature
+	// corruptBadges maps badges that failed to decode to their modtime at
+	// the time, so discovery leaves them out until the file changes.
+	corruptBadges = make(map[string]time.Time)
+	// lastEmptyRediscover is when a request last found no badges and started
+	// a discovery.
+	lastEmptyRediscover time.Time
+
+	// badgeDimensions holds each local raster badge's size when
+	// recordDimensions is set. It is replaced, never modified, by
+	// discoverBadges.
+	badgeDimensions map[string]badgeSize
+
+	// badgeBytes caches served badge files in memory. It is nil when caching
+	// is disabled with BADGE_CACHE=0.
+	badgeBytes *badgeCache
+
+	// servePlaceholder reports whether placeholderBadge replaces the 404 for
+	// an empty badge list.
+	servePlaceholder = true
+
+	// recordDimensions, set by RECORD_DIMENSIONS=1, has discovery read each
+	// badge's size for /badges.json.
+	recordDimensions bool
+
+	// strictSlot, set by STRICT_SLOT=1, makes a missing, malformed or
+	// out-of-range slot a 400 instead of slot 1; see checkStrictSlot.
+	strictSlot bool
+
+	// featuredBadge, from FEATURED_BADGE, is always served in slot 1 when it
+	// is among the candidate badges.
+	featuredBadge string
+
+	// instanceSalt is the FNV-1a hash of INSTANCE_SALT, or 0 when unset so
+	// unsalted deployments keep the plain time-window shuffle.
+	instanceSalt int64
+
+	// discoveryInterval, from DISCOVERY_INTERVAL, is how old the badge list
+	// may get before a badge request triggers another discovery.
+	discoveryInterval = defaultDiscoveryInterval
+	// discoveryStaleAfter is discoveryInterval with this instance's jitter
+	// applied. It is drawn once at startup, so each instance rediscovers on
+	// a steady schedule that is offset from the others.
+	discoveryStaleAfter = defaultDiscoveryInterval
+
+	// rotationWindowSeconds is how long a shuffle stays fixed. Every slot is
+	// seeded from the same window, so all slots change together when it ends.
+	rotationWindowSeconds int64 = defaultRotationWindowSeconds
+	// rotationMode, from ROTATION_MODE, is "window" to rotate every
+	// rotationWindowSeconds, "daily" to rotate at midnight in
+	// rotationLocation, "fixed" to never shuffle, or "session" to step each
+	// client through the badges one request at a time.
+	rotationMode = "window"
+	// rotationLocation, from TZ, is the time zone daily rotation follows.
+	rotationLocation = time.Local
+)
+
+// resolveBadgesDir returns the badges directory from BADGES_DIR, falling back
+// to defaultBadgesDir. A leading "~" is expanded to the user's home directory.
+func resolveBadgesDir() string {
+	dir := strings.TrimSpace(os.Getenv("BADGES_DIR"))
+	if dir == "" {
+		return defaultBadgesDir
+	}
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			slog.Warn("could not expand ~ in BADGES_DIR", "value", dir, "error", err)
+		} else {
+			dir = filepath.Join(home, dir[1:])
+		}
+	}
+	return filepath.Clean(dir)
+}
+
+// checkBadgesDir reports whether badgesDir exists, is a directory and can be
+// listed.
+func checkBadgesDir() error {
+	info, err := os.Stat(badgesDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", badgesDir)
+	}
+	_, err = os.ReadDir(badgesDir)
+	return err
+}
+
+// resolveListenAddr returns the address to listen on: LISTEN_ADDR when set,
+// otherwise all interfaces on PORT or defaultPort. LISTEN_ADDR must be a
+// host:port pair, with an empty host meaning all interfaces.
+func resolveListenAddr() (string, error) {
+	addr := strings.TrimSpace(os.Getenv("LISTEN_ADDR"))
+	if addr == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = defaultPort
+		}
+		return ":" + port, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return addr, nil
+}
+
+// resolveLogLevel reads LOG_LEVEL (debug, info, warn or error), defaulting
+// to info.
+func resolveLogLevel() slog.Level {
+	var level slog.Level
+	value := strings.TrimSpace(os.Getenv("LOG_LEVEL"))
+	if value == "" {
+		return slog.LevelInfo
+	}
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid LOG_LEVEL %q, using info\n", value)
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// resolveRotationWindow reads ROTATION_WINDOW_SECONDS, falling back to
+// defaultRotationWindowSeconds when it is unset or not a positive integer.
+func resolveRotationWindow() int64 {
+	value := strings.TrimSpace(os.Getenv("ROTATION_WINDOW_SECONDS"))
+	if value == "" {
+		return defaultRotationWindowSeconds
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		slog.Warn("invalid ROTATION_WINDOW_SECONDS, using default", "value", value, "default", defaultRotationWindowSeconds)
+		return defaultRotationWindowSeconds
+	}
+	return seconds
+}
+
+// resolveDiscoveryInterval reads DISCOVERY_INTERVAL as a Go duration such as
+// "30s" or "10m", falling back to defaultDiscoveryInterval when it is unset
+// or not positive.
+func resolveDiscoveryInterval() time.Duration {
+	value := strings.TrimSpace(os.Getenv("DISCOVERY_INTERVAL"))
+	if value == "" {
+		return defaultDiscoveryInterval
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		slog.Warn("invalid DISCOVERY_INTERVAL, using default", "value", value, "default", defaultDiscoveryInterval.String())
+		return defaultDiscoveryInterval
+	}
+	return interval
+}
+
+// resolveDiscoveryJitter reads DISCOVERY_JITTER, the percentage, from 0 up
+// to but not including 100, by which discoveryInterval may be shortened or
+// lengthened on each instance.
+func resolveDiscoveryJitter() float64 {
+	value := strings.TrimSpace(os.Getenv("DISCOVERY_JITTER"))
+	if value == "" {
+		return defaultDiscoveryJitter
+	}
+	percent, err := strconv.ParseFloat(value, 64)
+	if err != nil || percent < 0 || percent >= 100 {
+		slog.Warn("invalid DISCOVERY_JITTER, using default", "value", value, "default", defaultDiscoveryJitter)
+		return defaultDiscoveryJitter
+	}
+	return percent
+}
+
+// jitterInterval returns interval scaled by a random factor within percent
+// either side of 1, so the average across instances stays interval.
+func jitterInterval(interval time.Duration, percent float64) time.Duration {
+	factor := 1 + (rand.Float64()*2-1)*percent/100
+	return time.Duration(float64(interval) * factor)
+}
+
+// resolveBadgeCache builds the in-memory badge cache from BADGE_CACHE and
+// BADGE_CACHE_MAX_BYTES, returning nil when caching is disabled.
+func resolveBadgeCache() *badgeCache {
+	if os.Getenv("BADGE_CACHE") == "0" {
+		return nil
+	}
+	maxBytes := int64(defaultBadgeCacheMaxBytes)
+	if value := strings.TrimSpace(os.Getenv("BADGE_CACHE_MAX_BYTES")); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			slog.Warn("invalid BADGE_CACHE_MAX_BYTES, using default", "value", value, "default", maxBytes)
+		} else {
+			maxBytes = parsed
+		}
+	}
+	return newBadgeCache(maxBytes)
+}
+
+// badgeExt returns the lowercased extension of the badge name, from its
+// final dot, so "Badge.PNG.gif" is ".gif". Names without one, and hidden
+// files like ".gif" that are nothing but one, have none. Names are
+// slash-separated everywhere, so path.Ext gives the same answer on every
+// platform where filepath.Ext would also split at Windows backslashes.
+func badgeExt(name string) string {
+	base := path.Base(name)
+	ext := path.Ext(base)
+	if ext == base {
+		return ""
+	}
+	return strings.ToLower(ext)
+}
+
+// formatExt returns the extension a format query parameter such as "PNG"
+// stands for.
+func formatExt(format string) string {
+	return "." + strings.ToLower(format)
+}
+
+func isSupportedBadge(filename string) bool {
+	_, ok := badgeContentTypes[badgeExt(filename)]
+	return ok
+}
+
+// isRasterBadge reports whether filename is a bitmap badge rather than SVG.
+func isRasterBadge(filename string) bool {
+	return contentTypeFor(filename) != svgContentType
+}
+
+func contentTypeFor(filename string) string {
+	if contentType, ok := badgeContentTypes[badgeExt(filename)]; ok {
+		return contentType
+	}
+	return "image/gif"
+}
+
+// mimeOverrides, from MIME_OVERRIDES, maps badge extensions to the
+// Content-Type they are served with in place of the detected one, for
+// clients that need something unusual. Selection and processing still go
+// by the real type.
+var mimeOverrides map[string]string
+
+// resolveMIMEOverrides reads MIME_OVERRIDES, a JSON object such as
+// {".gif": "application/octet-stream"} given inline or as the path of a file
+// holding it. Keys are supported badge extensions, with or without the dot;
+// entries with other keys or unparseable media types are skipped.
+func resolveMIMEOverrides() map[string]string {
+	value := strings.TrimSpace(os.Getenv("MIME_OVERRIDES"))
+	if value == "" {
+		return nil
+	}
+	data := []byte(value)
+	if !strings.HasPrefix(value, "{") {
+		var err error
+		if data, err = os.ReadFile(value); err != nil {
+			slog.Warn("could not read MIME_OVERRIDES, using default content types", "file", value, "error", err)
+			return nil
+		}
+	}
+	var entries map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		slog.Warn("malformed MIME_OVERRIDES, using default content types", "error", err)
+		return nil
+	}
+	overrides := make(map[string]string, len(entries))
+	for ext, contentType := range entries {
+		key := "." + strings.ToLower(strings.TrimPrefix(ext, "."))
+		if _, ok := badgeContentTypes[key]; !ok {
+			slog.Warn("skipping MIME override for unsupported extension", "extension", ext)
+			continue
+		}
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			slog.Warn("skipping MIME override with invalid content type", "extension", ext, "contentType", contentType, "error", err)
+			continue
+		}
+		overrides[key] = contentType
+	}
+	return overrides
+}
+
+// servedContentType returns the Content-Type to send for filename: its
+// override when one is configured, otherwise detected.
+func servedContentType(filename, detected string) string {
+	if override, ok := mimeOverrides[badgeExt(filename)]; ok {
+		return override
+	}
+	return detected
+}
+
+// badgeSignatures reports whether data starts like a file of each supported
+// content type, the cheap check done before sniffing.
+var badgeSignatures = map[string]func(data []byte) bool{
+	"image/gif":  func(data []byte) bool { return bytes.HasPrefix(data, []byte("GIF8")) },
+	"image/png":  func(data []byte) bool { return bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) },
+	"image/jpeg": func(data []byte) bool { return bytes.HasPrefix(data, []byte("\xff\xd8\xff")) },
+	"image/webp": func(data []byte) bool {
+		return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+	},
+	"image/avif": func(data []byte) bool {
+		return len(data) >= 12 && string(data[4:8]) == "ftyp" && (string(data[8:12]) == "avif" || string(data[8:12]) == "avis")
+	},
+}
+
+// sniffMismatches records the badges already logged as mislabeled, so each
+// is only warned about once.
+var sniffMismatches sync.Map
+
+// detectContentType returns the Content-Type to serve filename with, given
+// the start of its contents. The extension's type is used when data carries
+// its signature; otherwise data is sniffed with http.DetectContentType and a
+// recognised image type overrides the extension.
+func detectContentType(filename string, data []byte) string {
+	contentType := contentTypeFor(filename)
+	if matches, ok := badgeSignatures[contentType]; ok && matches(data) {
+		return contentType
+	}
+	sniffed := http.DetectContentType(data[:min(len(data), 512)])
+	if !strings.HasPrefix(sniffed, "image/") || sniffed == contentType {
+		return contentType
+	}
+	if _, logged := sniffMismatches.LoadOrStore(filename, true); !logged {
+		slog.Warn("badge content does not match its extension, serving sniffed type", "filename", filename, "extensionType", contentType, "sniffedType", sniffed)
+	}
+	return sniffed
+}
+
+// looksLikeBadge reports whether head, the start of the badge filename,
+// begins like an image. A raster file may be in any supported format, since
+// a mismatched extension is served with its sniffed type.
+func looksLikeBadge(filename string, head []byte) bool {
+	if contentTypeFor(filename) == svgContentType {
+		trimmed := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+		return bytes.HasPrefix(trimmed, []byte("<"))
+	}
+	for _, matches := range badgeSignatures {
+		if matches(head) {
+			return true
+		}
+	}
+	return false
+}
+
+// markCorrupt drops the badge name, which failed to decode, from rotation
+// until its file changes. Remote badges have no modtime to go by, so they
+// are retried at the next discovery.
+func markCorrupt(name string, err error) {
+	slog.Warn("badge failed to decode, excluding it from rotation", "filename", name, "error", err)
+	badgeErrorsTotal.inc("corrupt")
+	badge, errLocate := locateBadge(name)
+	mu.Lock()
+	defer mu.Unlock()
+	if errLocate == nil {
+		corruptBadges[name] = badge.modTime
+	}
+	dropFromRotationLocked(name, "failed to decode")
+}
+
+// dropFromRotationLocked removes name from the badges and sequence in
+// badgeState ahead of the next discovery, listing it in discoverySkipped with reason.
+// The caller holds mu.
+func dropFromRotationLocked(name, reason string) {
+	state := snapshotBadges()
+	if !slices.Contains(state.files, name) {
+		return
+	}
+	isName := func(n string) bool { return n == name }
+	state.files = slices.DeleteFunc(slices.Clone(state.files), isName)
+	if state.sequence != nil {
+		state.sequence = slices.DeleteFunc(slices.Clone(state.sequence), isName)
+		if len(state.sequence) == 0 {
+			state.sequence = nil
+		}
+	}
+	badgeState.Store(&state)
+	discoverySkipped = append(slices.Clip(discoverySkipped), skippedBadge{Name: name, Reason: reason})
+	badgesDiscovered.Store(int64(len(state.files)))
+}
+
+// isCorrupt reports whether name failed to decode at modTime. An entry for
+// an older modtime is dropped, since the file has changed since.
+func isCorrupt(name string, modTime time.Time) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	failedAt, ok := corruptBadges[name]
+	if ok && !failedAt.Equal(modTime) {
+		delete(corruptBadges, name)
+		return false
+	}
+	return ok
+}
+
+// sniffBadgeFile reads the start of the badge file at path for
+// detectContentType.
+func sniffBadgeFile(filename, path string) (string, error) {
+	file, err := badgeFS.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return detectContentType(filename, head[:n]), nil
+}
+
+// discoverBadges walks badgesDir and swaps in the new badge list. The walk
+// runs without holding mu so requests keep serving the previous list. Only
+// one discovery runs at a time; a call made while one is in progress makes it
+// walk again once it finishes instead of starting a second walk.
+func discoverBadges() {
+	mu.Lock()
+	if discovering {
+		rediscover = true
+		mu.Unlock()
+		return
+	}
+	discovering = true
+	discoveryDone = make(chan struct{})
+	mu.Unlock()
+	runDiscovery()
+}
+
+// discoverInBackgroundLocked is discoverBadges on a new goroutine. It marks
+// the discovery as running before starting it, so requests arriving before
+// the goroutine is scheduled see it and don't start walks of their own. The
+// caller holds mu.
+func discoverInBackgroundLocked() {
+	if discovering {
+		rediscover = true
+		return
+	}
+	discovering = true
+	discoveryDone = make(chan struct{})
+	go runDiscovery()
+}
+
+// runDiscovery walks badgesDir until no further discovery has been asked
+// for, then marks discovery as finished. The caller has set discovering.
+func runDiscovery() {
+	for {
+		discoverBadgesOnce()
+
+		mu.Lock()
+		if !rediscover {
+			discovering = false
+			close(discoveryDone)
+			discoveryDone = nil
+			mu.Unlock()
+			return
+		}
+		rediscover = false
+		mu.Unlock()
+	}
+}
+
+// discoverBadgesAndWait runs discoverBadges and, when that only asked an
+// in-progress discovery to go again, waits for it to finish, so the badge
+// list reflects badgesDir as of the call when it returns.
+func discoverBadgesAndWait() {
+	discoverBadges()
+	mu.Lock()
+	done := discoveryDone
+	mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// awaitDiscovery waits for a running discovery to finish, or for ctx to be
+// done, in which case it returns ctx's error.
+func awaitDiscovery(ctx context.Context) error {
+	mu.Lock()
+	done := discoveryDone
+	mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// printDiscovery writes the badges and skipped files from the last discovery
+// for the -discover flag.
+func printDiscovery(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	files := currentBadgeFiles()
+	fmt.Fprintf(w, "Badges in %s: %d\n", badgeSource(), len(files))
+	for _, name := range files {
+		fmt.Fprintf(w, "  %s\n", name)
+	}
+	fmt.Fprintf(w, "Skipped: %d\n", len(discoverySkipped))
+	for _, skipped := range discoverySkipped {
+		fmt.Fprintf(w, "  %s (%s)\n", skipped.Name, skipped.Reason)
+	}
+}
+
+// skippedBadge is a file the last discovery found but left out of rotation.
+type skippedBadge struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// badgeListing is what one discovery found.
+type badgeListing struct {
+	names    []string
+	skipped  []skippedBadge
+	modTimes map[string]time.Time
+	// remote is set when the badges come from badgesURL.
+	remote map[string]remoteBadge
+	// signature summarises a walk of badgesDir; it is zero for a remote
+	// index.
+	signature dirSignature
+}
+
+// dirSignature is the newest modtime, in Unix nanoseconds, of any file or
+// directory under badgesDir and the number of files. Directories count
+// because renames and removals update their parent's modtime.
+type dirSignature struct {
+	newest int64
+	files  int
+}
+
+// walkBadgesDir lists the supported, readable badges in badgeFS.
+func walkBadgesDir() (badgeListing, error) {
+	listing := badgeListing{modTimes: make(map[string]time.Time)}
+	err := fs.WalkDir(badgeFS, ".", func(name string, d fs.DirEntry, errWalk error) error {
+		if errWalk != nil {
+			// Only a problem with the badges directory itself fails the
+			// discovery; an unreadable entry below it is skipped so the
+			// rest still rotate.
+			if name == "." {
+				return errWalk
+			}
+			slog.Warn("skipping unreadable badge path", "filename", name, "error", errWalk)
+			listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: fmt.Sprintf("unreadable: %v", errWalk)})
+			return nil
+		}
+		info, errInfo := d.Info()
+		if errInfo == nil {
+			listing.signature.newest = max(listing.signature.newest, info.ModTime().UnixNano())
+		}
+		if d.IsDir() {
+			return nil
+		}
+		listing.signature.files++
+		if d.Type()&fs.ModeSymlink != 0 {
+			// WalkDir doesn't follow symlinks, so stat the target to find a
+			// symlinked badge's real type and modtime.
+			info, errInfo = fs.Stat(badgeFS, name)
+			if errInfo != nil {
+				slog.Warn("skipping broken symlink", "filename", name, "error", errInfo)
+				listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: fmt.Sprintf("broken symlink: %v", errInfo)})
+				return nil
+			}
+			if info.IsDir() {
+				listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: "symlinked directory"})
+				return nil
+			}
+			listing.signature.newest = max(listing.signature.newest, info.ModTime().UnixNano())
+		}
+		if !isSupportedBadge(name) {
+			if name != weightsFile && name != sequenceFile && name != aliasesFile && !isSidecar(name) {
+				listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: "unsupported extension"})
+			}
+			return nil
+		}
+		if isExcluded(name) {
+			listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: excludedReason})
+			return nil
+		}
+		if errInfo == nil && info.Size() > maxBadgeBytes {
+			slog.Warn("skipping badge larger than MAX_BADGE_BYTES", "filename", name, "size", info.Size(), "max", maxBadgeBytes)
+			listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: fmt.Sprintf("%d bytes exceeds MAX_BADGE_BYTES", info.Size())})
+			return nil
+		}
+		file, err := badgeFS.Open(name)
+		if err != nil {
+			listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: fmt.Sprintf("unreadable: %v", err)})
+			return nil
+		}
+		head := make([]byte, 512)
+		n, err := io.ReadFull(file, head)
+		file.Close()
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: fmt.Sprintf("unreadable: %v", err)})
+			return nil
+		}
+		if n == 0 {
+			slog.Warn("skipping empty badge file", "filename", name)
+			listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: "empty file"})
+			return nil
+		}
+		if !looksLikeBadge(name, head[:n]) {
+			slog.Warn("skipping badge that is not a recognised image", "filename", name)
+			listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: "not a recognised image"})
+			return nil
+		}
+		listing.names = append(listing.names, name)
+		if errInfo == nil {
+			listing.modTimes[name] = info.ModTime()
+		}
+		return nil
+	})
+	return listing, err
+}
+
+// badgeOrder, from ORDER, is how discovery orders the badge list: "name",
+// "mtime" or "none". The order is the input to selection, so under the
+// default shuffle it only changes which permutation each window gets; it
+// matters for modes that walk the list in order.
+var badgeOrder = "name"
+
+// resolveBadgeOrder reads ORDER, falling back to "name" when it is unset or
+// unknown.
+func resolveBadgeOrder() string {
+	switch value := strings.TrimSpace(os.Getenv("ORDER")); value {
+	case "":
+		return "name"
+	case "name", "mtime", "none":
+		return value
+	default:
+		slog.Warn("invalid ORDER, sorting by name", "value", value)
+		return "name"
+	}
+}
+
+// orderBadges sorts names in place by badgeOrder: alphabetically, newest
+// modtime first with ties by name, or left in the order they were found,
+// which is lexical per directory for badgesDir and index order for
+// BADGES_URL.
+func orderBadges(names []string, modTimes map[string]time.Time) {
+	switch badgeOrder {
+	case "mtime":
+		sort.SliceStable(names, func(i, j int) bool {
+			ti, tj := modTimes[names[i]], modTimes[names[j]]
+			if !ti.Equal(tj) {
+				return ti.After(tj)
+			}
+			return names[i] < names[j]
+		})
+	case "none":
+	default:
+		sort.Strings(names)
+	}
+}
+
+const defaultMaxBadgeBytes = 10 << 20
+
+// maxBadgeBytes, from MAX_BADGE_BYTES, is the largest badge file discovery
+// accepts, so one oversized file can't slow or exhaust the server.
+var maxBadgeBytes int64 = defaultMaxBadgeBytes
+
+func resolveMaxBadgeBytes() int64 {
+	value := strings.TrimSpace(os.Getenv("MAX_BADGE_BYTES"))
+	if value == "" {
+		return defaultMaxBadgeBytes
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		slog.Warn("invalid MAX_BADGE_BYTES, using default", "value", value, "default", defaultMaxBadgeBytes)
+		return defaultMaxBadgeBytes
+	}
+	return limit
+}
+
+// newestN, from NEWEST_N, limits rotation to the N most recently modified
+// badges, or to all of them when 0. Trimming the pool changes which badge
+// each slot maps to, so slots shift whenever a newer badge pushes an older
+// one out. Remote badges all share their listing time, so for them it keeps
+// the first N by name.
+var newestN int
+
+// minBadges, from MIN_BADGES, is how many badges discovery must find before
+// /badge.gif serves any. Below it requests get a 503 saying setup is
+// incomplete, rather than a wall of repeated badges.
+var minBadges = 1
+
+func resolveMinBadges() int {
+	value := strings.TrimSpace(os.Getenv("MIN_BADGES"))
+	if value == "" {
+		return 1
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		slog.Warn("invalid MIN_BADGES, serving from the first badge", "value", value)
+		return 1
+	}
+	return n
+}
+
+func resolveNewestN() int {
+	value := strings.TrimSpace(os.Getenv("NEWEST_N"))
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		slog.Warn("invalid NEWEST_N, rotating all badges", "value", value)
+		return 0
+	}
+	return n
+}
+
+// newestBadges splits names into the n most recently modified, newest first
+// with ties by name, and the rest. It returns names and nil when n is 0 or
+// covers them all.
+func newestBadges(names []string, modTimes map[string]time.Time, n int) ([]string, []string) {
+	if n == 0 || len(names) <= n {
+		return names, nil
+	}
+	sorted := slices.Clone(names)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ti, tj := modTimes[sorted[i]], modTimes[sorted[j]]
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return sorted[i] < sorted[j]
+	})
+	return sorted[:n], sorted[n:]
+}
+
+// excludePattern, from EXCLUDE_PATTERN, is a path.Match glob such as
+// "*_draft.*". Badges whose name or file name matches it are not discovered.
+var excludePattern string
+
+const excludedReason = "excluded by EXCLUDE_PATTERN"
+
+// resolveExcludePattern reads EXCLUDE_PATTERN, ignoring it with a warning
+// when it is not a valid glob.
+func resolveExcludePattern() string {
+	pattern := strings.TrimSpace(os.Getenv("EXCLUDE_PATTERN"))
+	if pattern == "" {
+		return ""
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		slog.Warn("invalid EXCLUDE_PATTERN, excluding nothing", "value", pattern, "error", err)
+		return ""
+	}
+	return pattern
+}
+
+// isExcluded reports whether excludePattern matches the badge name, either
+// as a whole, like "wip/*", or by its last element, like "*_draft.*".
+func isExcluded(name string) bool {
+	if excludePattern == "" {
+		return false
+	}
+	whole, _ := path.Match(excludePattern, name)
+	base, _ := path.Match(excludePattern, path.Base(name))
+	return whole || base
+}
+
+// embeddedBadges is the badges directory compiled into the binary by builds
+// tagged embedbadges, and nil otherwise. When set it replaces badgesDir.
+var embeddedBadges fs.FS
+
+// badgeSource describes where badges are discovered from, for logs.
+func badgeSource() string {
+	if badgesURL != "" {
+		return badgesURL
+	}
+	if embeddedBadges != nil {
+		return "embedded"
+	}
+	return badgesDir
+}
+
+// discoverBadgesOnce lists badges from badgesURL when it is set and from
+// badgesDir otherwise. A failed listing keeps the previous badge list.
+func discoverBadgesOnce() {
+	slog.Debug("discovering badges", "source", badgeSource())
+	var listing badgeListing
+	var err error
+	if badgesURL != "" {
+		listing, err = fetchRemoteIndex(badgesURL)
+	} else {
+		listing, err = walkBadgesDir()
+	}
+	if err != nil {
+		slog.Error("badge discovery failed, keeping previous badges", "source", badgeSource(), "error", err)
+		badgeErrorsTotal.inc("discovery")
+		return
+	}
+
+	mu.Lock()
+	if badgesURL == "" && !lastDiscoveryTime.IsZero() && listing.signature == discoverySignature {
+		lastDiscoveryTime = time.Now()
+		mu.Unlock()
+		slog.Debug("badges unchanged since last discovery", "dir", badgesDir)
+		return
+	}
+	mu.Unlock()
+
+	discovered, modTimes := listing.names, listing.modTimes
+	discovered = slices.DeleteFunc(discovered, func(name string) bool {
+		if isCorrupt(name, modTimes[name]) {
+			listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: "failed to decode"})
+			return true
+		}
+		if isDisabled(name) {
+			listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: disabledReason})
+			return true
+		}
+		return false
+	})
+	if dedupeBadges && badgesURL == "" {
+		var duplicates []skippedBadge
+		discovered, duplicates = dedupeByContent(discovered, modTimes)
+		for _, duplicate := range duplicates {
+			delete(modTimes, duplicate.Name)
+		}
+		if len(duplicates) > 0 {
+			slog.Info("dropped duplicate badges", "badges", duplicates)
+		}
+		listing.skipped = append(listing.skipped, duplicates...)
+	}
+	discovered, older := newestBadges(discovered, modTimes, newestN)
+	for _, name := range older {
+		delete(modTimes, name)
+		listing.skipped = append(listing.skipped, skippedBadge{Name: name, Reason: fmt.Sprintf("older than the newest %d set by NEWEST_N", newestN)})
+	}
+	if len(older) > 0 {
+		slog.Info("rotating only the newest badges", "newestN", newestN, "dropped", len(older))
+	}
+	if badgeBytes != nil {
+		badgeBytes.prune(modTimes)
+	}
+	if diskBadges != nil {
+		diskBadges.prune(modTimes)
+	}
+	var excluded []string
+	for _, skipped := range listing.skipped {
+		if skipped.Reason == excludedReason {
+			excluded = append(excluded, skipped.Name)
+		}
+	}
+	if len(excluded) > 0 {
+		slog.Info("excluded badges", "pattern", excludePattern, "badges", excluded)
+	}
+	if len(discovered) > 0 {
+		orderBadges(discovered, modTimes)
+		slog.Info("discovered badges", "count", len(discovered), "badges", discovered)
+	} else {
+		slog.Warn("no supported badges found", "source", badgeSource())
+		discovered = []string{}
+	}
+	weights := loadWeights()
+	aliases := loadAliases(discovered)
+	var metadata map[string]badgeMeta
+	var dimensions map[string]badgeSize
+	if badgesURL == "" {
+		metadata = loadMetadata(discovered)
+		if recordDimensions {
+			dimensions = loadDimensions(discovered)
+		}
+	}
+	sequence := loadSequence(discovered)
+	if featuredBadge != "" && !slices.Contains(discovered, featuredBadge) {
+		slog.Warn("featured badge not found, using normal rotation", "filename", featuredBadge)
+	}
+
+	mu.Lock()
+	badgeState.Store(&badgeSnapshot{files: discovered, weights: weights, sequence: sequence, aliases: aliases, metadata: metadata})
+	badgeDimensions = dimensions
+	discoverySkipped = listing.skipped
+	remoteBadges = listing.remote
+	discoverySignature = listing.signature
+	lastDiscoveryTime = time.Now()
+	mu.Unlock()
+	badgesDiscovered.Store(int64(len(discovered)))
+}
+
+// badgeSnapshot is the discovery state one request selects from. Discovery
+// publishes a new one in badgeState rather than changing it, so each
+// request sees one consistent view.
+type badgeSnapshot struct {
+	files    []string
+	weights  map[string]int
+	sequence []string
+	aliases  map[string]badgeAlias
+	metadata map[string]badgeMeta
+	// keep is the format filter pick applies to its selection, or nil.
+	keep func(string) bool
+}
+
+// currentBadgeFiles returns the discovered badges, nil before the first
+// discovery. The slice is shared and must not be modified.
+func currentBadgeFiles() []string {
+	return snapshotBadges().files
+}
+
+// snapshotBadges returns the published discovery state, empty before the
+// first discovery, without taking mu.
+func snapshotBadges() badgeSnapshot {
+	if state := badgeState.Load(); state != nil {
+		return *state
+	}
+	return badgeSnapshot{}
+}
+
+// candidates returns the badges a request selects from, narrowed by group
+// and format: the loaded sequence in its order, or otherwise every badge.
+func (s badgeSnapshot) candidates(group, format string) []string {
+	files := s.files
+	if s.sequence != nil {
+		files = s.sequence
+	}
+	files = narrowToGroup(files, group)
+	return narrowToFormat(files, format)
+}
+
+// pick selects the badge for slot from candidates with the featured badge
+// pinned to slot 1, using the strategy rotationModes builds for the
+// configured ROTATION_MODE.
+//
+// A format, when set, is applied after selection rather than to the
+// candidates: the strategy orders every candidate and the slot counts only
+// badges in that format, so slot=1&format=png is the first PNG in the order
+// the unfiltered slots follow. candidates is then the list narrowed by group
+// alone, and format is ignored when none of it matches.
+//
+// instanceSalt is added to seed first, so deployments with different
+// INSTANCE_SALT values shuffle differently for the same rotation window.
+// Adding rather than mixing the bits keeps consecutive seeds consecutive, so
+// a sequence still steps one position per window, just from an offset.
+// Session positions are left unsalted; each client starts at a random one
+// anyway.
+//
+// The result depends only on the seed, which comes from the wall clock, the
+// seed, key and ns parameters and INSTANCE_SALT; the candidates in their
+// discovered order; the weights, sequence and featured badge; and the slot.
+// Nothing in it is tied to the process, so restarts and other replicas
+// serve the same badge for a slot within a window. Selection must keep to
+// this: per-process randomness belongs only in handlers like /random.gif
+// that opt out of rotation.
+func (s badgeSnapshot) pick(candidates []string, format string, seed int64, slot int) (string, error) {
+	if rotationMode != "session" {
+		seed += instanceSalt
+	}
+	s.keep = formatFilter(candidates, format)
+	featured := featuredBadge
+	if s.keep != nil && featured != "" && slices.Contains(candidates, featured) {
+		if !s.keep(featured) {
+			// Unfiltered slots order the badges other than the featured one,
+			// so filtered slots must too.
+			candidates = slices.DeleteFunc(slices.Clone(candidates), func(name string) bool { return name == featured })
+			featured = ""
+		} else if !slices.ContainsFunc(candidates, func(name string) bool { return name != featured && s.keep(name) }) {
+			// The featured badge is the only one in the format, so it fills
+			// every slot, as it does when it is the only candidate.
+			return featured, nil
+		}
+	}
+	strategy := featuredStrategy{featured: featured, next: newStrategy(s)}
+	return strategy.Select(candidates, seed, slot)
+}
+
+// loadSequence reads sequenceFile from badgesDir, a JSON array of badge
+// names in the order slots should show them. Entries not in discovered are
+// skipped and logged. It returns nil, meaning shuffled selection, when the
+// file is missing, malformed, or names no discovered badge.
+func loadSequence(discovered []string) []string {
+	data, err := fs.ReadFile(badgeFS, sequenceFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("could not read sequence, using shuffled selection", "file", sequenceFile, "error", err)
+		}
+		return nil
+	}
+	var entries []string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		slog.Warn("malformed sequence, using shuffled selection", "file", sequenceFile, "error", err)
+		return nil
+	}
+	sequence := make([]string, 0, len(entries))
+	for _, name := range entries {
+		if slices.Contains(discovered, name) {
+			sequence = append(sequence, name)
+		} else {
+			slog.Warn("skipping sequence entry for missing badge", "file", sequenceFile, "filename", name)
+		}
+	}
+	if len(sequence) == 0 {
+		slog.Warn("sequence names no discovered badges, using shuffled selection", "file", sequenceFile)
+		return nil
+	}
+	slog.Info("loaded badge sequence", "file", sequenceFile, "count", len(sequence))
+	return sequence
+}
+
+// badgeAlias is what an aliasesFile entry names: a slot, or a badge served
+// regardless of rotation.
+type badgeAlias struct {
+	slot     int
+	filename string
+}
+
+// loadAliases reads aliasesFile from badgeFS, a JSON object mapping labels
+// to slot numbers or badge names, such as {"header": 1, "footer":
+// "seasonal/winter.gif"}. Entries that are neither are skipped and logged,
+// as are badge names not in discovered. It returns nil when the file is
+// missing or malformed.
+func loadAliases(discovered []string) map[string]badgeAlias {
+	data, err := fs.ReadFile(badgeFS, aliasesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("could not read aliases", "file", aliasesFile, "error", err)
+		}
+		return nil
+	}
+	var entries map[string]any
+	if err := json.Unmarshal(data, &entries); err != nil {
+		slog.Warn("malformed aliases", "file", aliasesFile, "error", err)
+		return nil
+	}
+	aliases := make(map[string]badgeAlias, len(entries))
+	for label, target := range entries {
+		switch target := target.(type) {
+		case float64:
+			if target < 1 || target != float64(int(target)) {
+				slog.Warn("skipping alias with invalid slot", "file", aliasesFile, "name", label, "slot", target)
+				continue
+			}
+			aliases[label] = badgeAlias{slot: int(target)}
+		case string:
+			if !slices.Contains(discovered, target) {
+				slog.Warn("skipping alias for missing badge", "file", aliasesFile, "name", label, "filename", target)
+				continue
+			}
+			aliases[label] = badgeAlias{filename: target}
+		default:
+			slog.Warn("skipping alias that is neither a slot nor a badge name", "file", aliasesFile, "name", label)
+		}
+	}
+	slog.Info("loaded badge aliases", "file", aliasesFile, "count", len(aliases))
+	return aliases
+}
+
+// resolveAlias returns the slot or pinned badge the name parameter stands
+// for. An unknown name, or one pinned to a badge no longer in rotation,
+// falls back to slot 1.
+func (s badgeSnapshot) resolveAlias(r *http.Request, name string) (int, string) {
+	alias, ok := s.aliases[name]
+	if !ok {
+		requestLog(r).Warn("unknown badge alias, using slot 1", "name", name)
+		return 1, ""
+	}
+	if alias.filename != "" && !slices.Contains(s.files, alias.filename) {
+		requestLog(r).Warn("aliased badge is not in rotation, using slot 1", "name", name, "filename", alias.filename)
+		return 1, ""
+	}
+	return alias.slot, alias.filename
+}
+
+// badgeMeta is the contents of a badge's sidecar file, the badge's name plus
+// ".json", such as "winter.gif.json".
+type badgeMeta struct {
+	Title string `json:"title"`
+	Link  string `json:"link"`
+	Alt   string `json:"alt"`
+}
+
+const sidecarSuffix = ".json"
+
+// isSidecar reports whether name is a badge's metadata sidecar.
+func isSidecar(name string) bool {
+	badge, ok := strings.CutSuffix(name, sidecarSuffix)
+	return ok && isSupportedBadge(badge)
+}
+
+// loadMetadata reads the sidecar of each discovered badge from badgeFS.
+// Badges without one are left out; malformed sidecars are logged and also
+// left out.
+func loadMetadata(discovered []string) map[string]badgeMeta {
+	metadata := make(map[string]badgeMeta)
+	for _, name := range discovered {
+		data, err := fs.ReadFile(badgeFS, name+sidecarSuffix)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("could not read badge metadata", "filename", name, "error", err)
+			}
+			continue
+		}
+		var meta badgeMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			slog.Warn("malformed badge metadata", "filename", name, "error", err)
+			continue
+		}
+		metadata[name] = meta
+	}
+	if len(metadata) > 0 {
+		slog.Info("loaded badge metadata", "count", len(metadata))
+	}
+	return metadata
+}
+
+// badgeSize is a badge's width and height in pixels.
+type badgeSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// loadDimensions reads the size of each discovered raster badge from its
+// header, without decoding frames. SVGs, which have no pixel size, and
+// formats the standard library can't read, such as WebP, are left out.
+func loadDimensions(discovered []string) map[string]badgeSize {
+	dimensions := make(map[string]badgeSize)
+	for _, name := range discovered {
+		if !isRasterBadge(name) {
+			continue
+		}
+		f, err := badgeFS.Open(name)
+		if err != nil {
+			slog.Warn("could not read badge dimensions", "filename", name, "error", err)
+			continue
+		}
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			slog.Debug("could not read badge dimensions", "filename", name, "error", err)
+			continue
+		}
+		dimensions[name] = badgeSize{Width: config.Width, Height: config.Height}
+	}
+	return dimensions
+}
+
+// maxBadgeWeight caps the weights in weightsFile. applyWeights repeats a
+// badge once per unit of weight on every selection, so an unbounded weight
+// would make every request allocate and shuffle as much.
+const maxBadgeWeight = 100
+
+// loadWeights reads weightsFile from badgesDir. It returns nil, meaning
+// uniform selection, when the file is missing or malformed. Weights below 1
+// count as 1 and weights over maxBadgeWeight as maxBadgeWeight.
+func loadWeights() map[string]int {
+	data, err := fs.ReadFile(badgeFS, weightsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("could not read weights, using uniform selection", "file", weightsFile, "error", err)
+		}
+		return nil
+	}
+	var weights map[string]int
+	if err := json.Unmarshal(data, &weights); err != nil {
+		slog.Warn("malformed weights, using uniform selection", "file", weightsFile, "error", err)
+		return nil
+	}
+	for name, weight := range weights {
+		if weight < 1 {
+			slog.Warn("weight is not positive, using 1", "file", weightsFile, "filename", name, "weight", weight)
+			weights[name] = 1
+		} else if weight > maxBadgeWeight {
+			slog.Warn("weight is over the maximum, using the maximum", "file", weightsFile, "filename", name, "weight", weight, "max", maxBadgeWeight)
+			weights[name] = maxBadgeWeight
+		}
+	}
+	slog.Info("loaded badge weights", "file", weightsFile, "count", len(weights))
+	return weights
+}
+
+// applyWeights repeats each badge by its weight so heavier badges fill more
+// shuffle positions. Badges missing from weights count once.
+func applyWeights(files []string, weights map[string]int) []string {
+	if len(weights) == 0 {
+		return files
+	}
+	weighted := make([]string, 0, len(files))
+	for _, name := range files {
+		weight, ok := weights[name]
+		if !ok {
+			weight = 1
+		}
+		for i := 0; i < weight; i++ {
+			weighted = append(weighted, name)
+		}
+	}
+	return weighted
+}
+
+func selectBadgeForSlot(availableBadges []string, baseSeed int64, slot int) (string, []string) {
+	if len(availableBadges) == 0 {
+		return "", availableBadges
+	}
+
+	r := rand.New(rand.NewSource(baseSeed + int64(slot)))
+
+	idxToPick := r.Intn(len(availableBadges))
+	selected := availableBadges[idxToPick]
+
+	remainingBadges := make([]string, 0, len(availableBadges)-1)
+	remainingBadges = append(remainingBadges, availableBadges[:idxToPick]...)
+	remainingBadges = append(remainingBadges, availableBadges[idxToPick+1:]...)
+
+	return selected, remainingBadges
+}
+
+// filterByFormat returns the badges whose extension matches format, such as
+// "png" or "gif". Extensions of the same type match each other, so "jpg"
+// also selects .jpeg files. The result is empty when nothing matches.
+func filterByFormat(files []string, format string) []string {
+	contentType := badgeContentTypes[formatExt(format)]
+	var filtered []string
+	for _, name := range files {
+		if isSupportedBadge(name) && contentTypeFor(name) == contentType {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+// formatFilter reports whether a badge is in format, as narrowToFormat would
+// keep it from files, or returns nil when narrowToFormat would keep them all.
+func formatFilter(files []string, format string) func(string) bool {
+	if format == "" {
+		return nil
+	}
+	contentType, ok := badgeContentTypes[formatExt(format)]
+	if !ok {
+		return nil
+	}
+	keep := func(name string) bool {
+		return isSupportedBadge(name) && contentTypeFor(name) == contentType
+	}
+	if !slices.ContainsFunc(files, keep) {
+		return nil
+	}
+	return keep
+}
+
+// narrowToFormat applies the format query parameter, returning files
+// unchanged when format is empty, unsupported, or matches nothing.
+func narrowToFormat(files []string, format string) []string {
+	if format == "" {
+		return files
+	}
+	if _, ok := badgeContentTypes[formatExt(format)]; !ok {
+		slog.Warn("ignoring unsupported format parameter", "format", format)
+		return files
+	}
+	if filtered := filterByFormat(files, format); len(filtered) > 0 {
+		return filtered
+	}
+	slog.Info("no badges match format, using all badges", "format", format)
+	return files
+}
+
+// narrowToGroup applies the group query parameter, keeping only badges inside
+// that subfolder of badgesDir. files is returned unchanged when group is
+// empty or matches nothing.
+func narrowToGroup(files []string, group string) []string {
+	group = strings.Trim(group, "/")
+	if group == "" {
+		return files
+	}
+	prefix := group + "/"
+	var filtered []string
+	for _, name := range files {
+		if strings.HasPrefix(name, prefix) {
+			filtered = append(filtered, name)
+		}
+	}
+	if len(filtered) > 0 {
+		return filtered
+	}
+	slog.Info("no badges in group, using all badges", "group", group)
+	return files
+}
+
+// resolveInstanceSalt hashes INSTANCE_SALT into the value added to every
+// selection seed. The salt is fixed per deployment rather than per process,
+// so restarts never change the rotation.
+func resolveInstanceSalt() int64 {
+	salt := os.Getenv("INSTANCE_SALT")
+	if salt == "" {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(salt))
+	return int64(h.Sum64())
+}
+
+// resolveSeed returns the shuffle seed for a request: the seed query
+// parameter when set, a hash of the key parameter when that is, otherwise
+// the current rotation window. A hash of the namespace in the ns parameter
+// is added to it, so embeds using different namespaces rotate independently
+// while each stays fixed within a window. It is added rather than mixed in
+// so consecutive windows keep consecutive seeds, which sequences step by.
+//
+// key is for assigning badges to entities, such as key=<username> for a
+// badge per user that never changes; seed is for testing a window's
+// selection. Both set is an error, since only one can apply.
+func resolveSeed(query url.Values) (int64, error) {
+	seed := windowSeed(time.Now())
+	seedStr, key := query.Get("seed"), query.Get("key")
+	if seedStr != "" && key != "" {
+		return 0, errors.New("seed and key can't be used together")
+	}
+	if seedStr != "" {
+		parsed, err := strconv.ParseInt(seedStr, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid seed parameter %q", seedStr)
+		}
+		seed = parsed
+	}
+	if key != "" {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		seed = int64(h.Sum64())
+	}
+	if ns := query.Get("ns"); ns != "" {
+		h := fnv.New64a()
+		h.Write([]byte(ns))
+		seed += int64(h.Sum64())
+	}
+	return seed, nil
+}
+
+// hasExplicitSeed reports whether query's seed or key parameter replaces the
+// rotation's seed, so the badge doesn't change with time or session.
+func hasExplicitSeed(query url.Values) bool {
+	return query.Get("seed") != "" || query.Get("key") != ""
+}
+
+const sessionCookie = "badge_position"
+
+// advanceSession returns the client's position for ROTATION_MODE=session,
+// from its sessionCookie, and sets the cookie to the next position. Clients
+// without a valid cookie start at a random position.
+func advanceSession(w http.ResponseWriter, r *http.Request) int64 {
+	position, _ := sessionPosition(r)
+	setSessionCookie(w, r, position+1)
+	return position
+}
+
+// peekSession returns the position advanceSession would return next without
+// advancing it. A client without a valid cookie is given one at its random
+// start, so its next badge request starts there.
+func peekSession(w http.ResponseWriter, r *http.Request) int64 {
+	position, ok := sessionPosition(r)
+	if !ok {
+		setSessionCookie(w, r, position)
+	}
+	return position
+}
+
+// sessionPosition returns the position in r's sessionCookie, or a random one
+// and false when it has no valid cookie.
+func sessionPosition(r *http.Request) (int64, bool) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if parsed, err := strconv.ParseInt(cookie.Value, 10, 64); err == nil && parsed >= 0 && parsed < math.MaxInt64 {
+			return parsed, true
+		}
+	}
+	return rand.Int63n(math.MaxInt32), false
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, position int64) {
+	// Embeds are usually on another site, where only SameSite=None cookies
+	// are sent, and browsers accept those only over HTTPS.
+	secure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	sameSite := http.SameSiteLaxMode
+	if secure {
+		sameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    strconv.FormatInt(position, 10),
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: sameSite,
+	})
+}
+
+// parseSlot converts the slot query parameter into a slot number, defaulting
+// to slot 1 when it is missing or less than 1. There is no upper bound; see
+// shuffleStrategy for how large slots wrap. checkStrictSlot rejects what this
+// forgives when STRICT_SLOT is set.
+func parseSlot(slotStr string) int {
+	slot, err := strconv.Atoi(slotStr)
+	if err != nil || slot < 1 {
+		slog.Debug("invalid or missing slot parameter, using slot 1", "slot", slotStr)
+		return 1
+	}
+	return slot
+}
+
+// checkTotalSlots validates the optional slots query parameter, the number
+// of slots the client embeds side by side. It returns an error when slots is
+// malformed or slot falls outside 1..slots, and warns when there are more
+// slots than badges, because slots past badgeCount repeat earlier ones.
+func checkTotalSlots(slotsStr string, slot, badgeCount int) error {
+	if slotsStr == "" {
+		return nil
+	}
+	totalSlots, err := strconv.Atoi(slotsStr)
+	if err != nil || totalSlots < 1 {
+		return fmt.Errorf("invalid slots parameter %q", slotsStr)
+	}
+	if slot > totalSlots {
+		return fmt.Errorf("slot %d exceeds slots=%d", slot, totalSlots)
+	}
+	if totalSlots > badgeCount {
+		slog.Warn("more slots than badges, slots past the badge count repeat earlier badges", "slots", totalSlots, "badges", badgeCount)
+	}
+	return nil
+}
+
+// checkStrictSlot validates the slot query parameter when strictSlot is set,
+// returning an error unless it is a number in 1..badgeCount, the range of
+// slots that select distinct badges. Without strictSlot it accepts anything
+// and parseSlot's defaults apply.
+func checkStrictSlot(slotStr string, badgeCount int) error {
+	if !strictSlot {
+		return nil
+	}
+	if slotStr == "" {
+		return fmt.Errorf("slot is required, from 1 to %d", badgeCount)
+	}
+	slot, err := strconv.Atoi(slotStr)
+	if err != nil || slot < 1 || slot > badgeCount {
+		return fmt.Errorf("invalid slot %q, must be from 1 to %d", slotStr, badgeCount)
+	}
+	return nil
+}
+
+var (
+	errNoBadges    = errors.New("no badges to select from")
+	errInvalidSlot = errors.New("slot must be at least 1")
 )
 
-var (
-	badgeFilesList    []string
-	mu                sync.Mutex
-	lastDiscoveryTime time.Time
-)
+// validateBadgeFilename rejects names that could escape badgesDir when joined
+// onto it, such as "../../etc/passwd" or absolute paths. Names are paths
+// relative to badgesDir using forward slashes, like "seasonal/winter.gif".
+func validateBadgeFilename(name string) error {
+	if name == "" || strings.Contains(name, `\`) || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return fmt.Errorf("invalid badge filename %q", name)
+	}
+	return nil
+}
+
+// locatedBadge is a badge name together with where it is read from, a path
+// in badgeFS or a remote URL, its modtime and its size in bytes. The size of
+// a remote badge isn't known until it is fetched and is -1.
+type locatedBadge struct {
+	name    string
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// locateBadge finds the badge name. For a local badge that has been removed
+// since discovery the error wraps fs.ErrNotExist.
+func locateBadge(name string) (locatedBadge, error) {
+	mu.Lock()
+	remote, ok := remoteBadges[name]
+	isRemote := remoteBadges != nil
+	mu.Unlock()
+	if isRemote {
+		if !ok {
+			return locatedBadge{}, fmt.Errorf("badge %q is not in the remote index", name)
+		}
+		return locatedBadge{name: name, path: remote.url, modTime: remote.listedAt, size: -1}, nil
+	}
+	info, err := fs.Stat(badgeFS, name)
+	if err != nil {
+		return locatedBadge{}, err
+	}
+	return locatedBadge{name: name, path: name, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// badgeETag returns a weak ETag identifying filename, processed as variant,
+// within the rotation window for baseSeed, so it changes whenever the window
+// advances.
+func badgeETag(filename, variant string, baseSeed int64) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%s|%d", filename, variant, baseSeed)
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison that If-None-Match calls for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheWindow reports whether CACHE_MODE=window is set, letting caches keep
+// rotating badges until the current rotation window ends.
+var cacheWindow bool
+
+// resolveCacheWindow reads CACHE_MODE, which is "nocache", the default, or
+// "window".
+func resolveCacheWindow() bool {
+	switch value := strings.TrimSpace(os.Getenv("CACHE_MODE")); value {
+	case "", "nocache":
+		return false
+	case "window":
+		return true
+	default:
+		slog.Warn("invalid CACHE_MODE, using nocache", "value", value)
+		return false
+	}
+}
+
+// setRotationCacheHeaders sets the caching headers for a badge picked by the
+// rotation: public until the current rotation window ends under
+// CACHE_MODE=window, and uncacheable otherwise.
+func setRotationCacheHeaders(w http.ResponseWriter) {
+	if !cacheWindow {
+		setNoCacheHeaders(w)
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", secondsUntilNextWindow()))
+}
+
+// secondsUntilNextWindow returns how long the current rotation window, and
+// so the default seed, lasts.
+func secondsUntilNextWindow() int64 {
+	now := time.Now()
+	_, end := rotationWindowBounds(now)
+	return max(1, int64(math.Ceil(end.Sub(now).Seconds())))
+}
+
+// rotationWindowBounds returns when the rotation window containing t began
+// and when it ends, at which point windowSeed moves on.
+func rotationWindowBounds(t time.Time) (start, end time.Time) {
+	if rotationMode == "daily" {
+		year, month, day := t.In(rotationLocation).Date()
+		return time.Date(year, month, day, 0, 0, 0, 0, rotationLocation), nextMidnight(t)
+	}
+	first := t.Unix() - t.Unix()%rotationWindowSeconds
+	return time.Unix(first, 0), time.Unix(first+rotationWindowSeconds, 0)
+}
+
+// setRotationTimingHeaders tells clients when the badge they were served
+// rotates out, so they can fetch the next one right at the boundary:
+// X-Rotation-Window-Seconds is the length of the current window and
+// X-Next-Rotation-Unix the Unix time it ends. Both are left out when the
+// badge won't rotate with time, in fixed and session mode or for an
+// explicit seed or key.
+func setRotationTimingHeaders(w http.ResponseWriter, r *http.Request) {
+	if rotationMode == "fixed" || rotationMode == "session" || hasExplicitSeed(r.URL.Query()) {
+		return
+	}
+	start, end := rotationWindowBounds(time.Now())
+	w.Header().Set("X-Rotation-Window-Seconds", strconv.FormatInt(int64(end.Sub(start).Seconds()), 10))
+	w.Header().Set("X-Next-Rotation-Unix", strconv.FormatInt(end.Unix(), 10))
+}
+
+// windowSeed returns the default seed for the rotation window containing t:
+// the window number, or in daily mode the number of days from 1970-01-01 to
+// the date in rotationLocation. Both count up by one per window, so
+// sequences step one badge at a time, across month and year ends too.
+func windowSeed(t time.Time) int64 {
+	if rotationMode == "daily" {
+		year, month, day := t.In(rotationLocation).Date()
+		// The calendar date is counted in UTC, where every day is 24 hours
+		// long, so DST changes in rotationLocation don't skew it.
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60)
+	}
+	return t.Unix() / rotationWindowSeconds
+}
+
+// nextMidnight returns the start of the day after t in rotationLocation.
+// It is computed from the calendar date, so days lengthened or shortened by
+// a DST change still end at local midnight; where a DST change skips
+// midnight itself, time.Date moves it to the first instant that exists.
+func nextMidnight(t time.Time) time.Time {
+	year, month, day := t.In(rotationLocation).Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, rotationLocation)
+}
+
+// resolveRotationMode reads ROTATION_MODE, one of rotationModes, falling
+// back to window rotation when it is unset or unknown.
+func resolveRotationMode() string {
+	switch value := strings.TrimSpace(os.Getenv("ROTATION_MODE")); value {
+	case "":
+		return "window"
+	default:
+		if _, ok := rotationModes[value]; ok {
+			return value
+		}
+		slog.Warn("invalid ROTATION_MODE, rotating by window", "value", value, "modes", slices.Sorted(maps.Keys(rotationModes)))
+		return "window"
+	}
+}
+
+// resolveRotationLocation loads the time zone named by TZ, such as
+// "Europe/Berlin", using the local zone when TZ is unset and UTC when it
+// names no known zone.
+func resolveRotationLocation() *time.Location {
+	name := strings.TrimSpace(os.Getenv("TZ"))
+	if name == "" {
+		return time.Local
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		slog.Warn("invalid TZ, rotating daily at UTC midnight", "value", name, "error", err)
+		return time.UTC
+	}
+	return location
+}
+
+func setNoCacheHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, public, max-age=0")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// writeError replies with message and code, as a JSON errorResponse when the
+// client accepts application/json and as plain text like http.Error
+// otherwise.
+func writeError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.Error(w, message, code)
+		return
+	}
+	body, err := json.Marshal(errorResponse{Error: message, Code: code})
+	if err != nil {
+		http.Error(w, message, code)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// newBadgeHandler returns the rotating badge handler. defaultFormat, such as
+// "png" for /badge.png, restricts selection like the format query parameter
+// does when the request doesn't set one; "" serves every supported format.
+func newBadgeHandler(defaultFormat string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveBadge(w, r, defaultFormat)
+	}
+}
+
+// rediscoverIfStale starts a background discovery once the badge list is
+// older than discoveryStaleAfter.
+func rediscoverIfStale() {
+	mu.Lock()
+	if !discovering && time.Since(lastDiscoveryTime) > discoveryStaleAfter {
+		discoverInBackgroundLocked()
+	}
+	mu.Unlock()
+}
+
+// rediscoverIfEmpty starts a background discovery for a request that found
+// no badges, at most once per emptyRediscoverCooldown, so badges that were
+// briefly missing during a deploy are picked up again quickly without
+// rescanning on every request while the directory really is empty.
+func rediscoverIfEmpty() {
+	mu.Lock()
+	defer mu.Unlock()
+	if discovering || time.Since(lastEmptyRediscover) < emptyRediscoverCooldown {
+		return
+	}
+	lastEmptyRediscover = time.Now()
+	discoverInBackgroundLocked()
+}
+
+// redirectBase, from REDIRECT_BASE, is a URL prefix such as
+// "https://cdn.example.com/badges/" that badge requests are redirected to,
+// with the selected badge's name appended, instead of being served. It is
+// empty to serve bytes.
+var redirectBase string
+
+func resolveRedirectBase() string {
+	value := strings.TrimSpace(os.Getenv("REDIRECT_BASE"))
+	if value == "" {
+		return ""
+	}
+	if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		slog.Warn("invalid REDIRECT_BASE, serving badges directly", "value", value)
+		return ""
+	}
+	return value
+}
+
+// redirectToBadge answers with a 302 to filename under redirectBase,
+// cacheable until the rotation window ends like the badge itself would be.
+// Processing parameters such as w and h don't apply to the redirect target.
+func redirectToBadge(w http.ResponseWriter, r *http.Request, filename string) {
+	target := redirectBase + (&url.URL{Path: filename}).EscapedPath()
+	requestLog(r).Debug("redirecting to badge", "filename", filename, "target", target)
+	noteServedBadge(r, filename)
+	recordServe(filename)
+	setRotationCacheHeaders(w)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// prefersPNG reports whether accept, an Accept header, ranks image/png above
+// image/gif, so a client that can take either gets no preference.
+func prefersPNG(accept string) bool {
+	return acceptQuality(accept, "image/png") > acceptQuality(accept, "image/gif")
+}
+
+// acceptQuality returns the q value accept gives mediaType, from the most
+// specific range that matches it, or 0 when none does.
+func acceptQuality(accept, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rangeStr, params, _ := strings.Cut(part, ";")
+		rangeStr = strings.ToLower(strings.TrimSpace(rangeStr))
+		var rank int
+		switch rangeStr {
+		case mediaType:
+			rank = 2
+		case typ + "/*":
+			rank = 1
+		case "*/*":
+			rank = 0
+		default:
+			continue
+		}
+		if rank <= specificity {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		quality, specificity = q, rank
+	}
+	return quality
+}
+
+// serveNoBadges answers a badge request made while no badges are discovered,
+// with the placeholder badge or a 404.
+func serveNoBadges(w http.ResponseWriter, r *http.Request) {
+	requestLog(r).Warn("no badges available to serve")
+	badgeErrorsTotal.inc("no_badges")
+	rediscoverIfEmpty()
+	if servePlaceholder {
+		setNoCacheHeaders(w)
+		w.Header().Set("Content-Type", "image/png")
+		http.ServeContent(w, r, "no-badges.png", startTime, bytes.NewReader(placeholderBadge))
+		return
+	}
+	writeError(w, r, "No badges available", http.StatusNotFound)
+}
+
+// serveTooFewBadges answers a badge request made while fewer than minBadges
+// badges are discovered with a 503, so an embed can show that setup is
+// incomplete.
+func serveTooFewBadges(w http.ResponseWriter, r *http.Request, count int) {
+	requestLog(r).Warn("too few badges to serve", "count", count, "minBadges", minBadges)
+	badgeErrorsTotal.inc("too_few_badges")
+	setNoCacheHeaders(w)
+	writeError(w, r, fmt.Sprintf("Setup incomplete: %d of %d required badges found", count, minBadges), http.StatusServiceUnavailable)
+}
+
+// setSlotHeaders tells clients how many slots are worth requesting:
+// X-Max-Slots is the number of distinct badges the request selects from,
+// after group and format narrowing, so slots 1 through X-Max-Slots show
+// every one of them (and no more, barring weights). Link points at
+// /badges.json, the full list. Both come from the request's snapshot.
+func setSlotHeaders(w http.ResponseWriter, maxSlots int) {
+	w.Header().Set("X-Max-Slots", strconv.Itoa(maxSlots))
+	w.Header().Set("Link", `</badges.json>; rel="collection"; type="application/json"`)
+}
+
+// serveBadge selects and serves the badge for a slot. Alongside the badge,
+// every response carries X-Badge-Count, the number of discovered badges,
+// and the headers set by setSlotHeaders and setRotationTimingHeaders.
+func serveBadge(w http.ResponseWriter, r *http.Request, defaultFormat string) {
+	rediscoverIfStale()
+
+	snapshot := snapshotBadges()
+	w.Header().Set("X-Badge-Count", strconv.Itoa(len(snapshot.files)))
+	if len(snapshot.files) == 0 {
+		setSlotHeaders(w, 0)
+		serveNoBadges(w, r)
+		return
+	}
+	if len(snapshot.files) < minBadges {
+		setSlotHeaders(w, len(snapshot.files))
+		serveTooFewBadges(w, r, len(snapshot.files))
+		return
+	}
+
+	baseSeed, err := resolveSeed(r.URL.Query())
+	if err != nil {
+		badgeErrorsTotal.inc("invalid_seed")
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rotationMode == "session" && !hasExplicitSeed(r.URL.Query()) {
+		baseSeed = advanceSession(w, r)
+	}
+	setRotationTimingHeaders(w, r)
 
-func discoverBadges() {
-	mu.Lock()
-	defer mu.Unlock()
-	log.Printf("Discovering badges in %s...\n", badgesDir)
-	var discovered []string
-	err := filepath.WalkDir(badgesDir, func(path string, d fs.DirEntry, errWalk error) error {
-		if errWalk != nil {
-			return errWalk
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = defaultFormat
+	}
+	if format == "" {
+		w.Header().Add("Vary", "Accept")
+		if prefersPNG(r.Header.Get("Accept")) {
+			format = "png"
 		}
-		if !d.IsDir() && (strings.HasSuffix(strings.ToLower(d.Name()), ".gif") || strings.HasSuffix(strings.ToLower(d.Name()), ".png")) {
-			discovered = append(discovered, d.Name())
+	}
+
+	slot := parseSlot(r.URL.Query().Get("slot"))
+	var pinned string
+	if name := r.URL.Query().Get("name"); name != "" {
+		slot, pinned = snapshot.resolveAlias(r, name)
+	}
+	pool := snapshot.candidates(r.URL.Query().Get("group"), "")
+	if defaultFormat != "" && format == defaultFormat && len(filterByFormat(pool, format)) == 0 {
+		// The route promises this format, so falling back to the other
+		// badges would serve them under the wrong extension.
+		setSlotHeaders(w, 0)
+		badgeErrorsTotal.inc("no_badges")
+		writeError(w, r, fmt.Sprintf("No %s badges available", strings.ToUpper(format)), http.StatusNotFound)
+		return
+	}
+	candidates := narrowToFormat(pool, format)
+	setSlotHeaders(w, len(candidates))
+	if r.URL.Query().Get("name") == "" {
+		if err := checkStrictSlot(r.URL.Query().Get("slot"), len(candidates)); err != nil {
+			badgeErrorsTotal.inc("invalid_slot")
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
 		}
-		return nil
+	}
+	if err := checkTotalSlots(r.URL.Query().Get("slots"), slot, len(candidates)); err != nil {
+		badgeErrorsTotal.inc("invalid_slots")
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	choose := func(pool []string) (string, error) {
+		if pinned != "" {
+			return pinned, nil
+		}
+		return snapshot.pick(pool, format, baseSeed, slot)
+	}
+	if redirectBase != "" {
+		selectedFilename, ok := chooseBadge(w, r, pool, choose)
+		if ok {
+			redirectToBadge(w, r, selectedFilename)
+		}
+		return
+	}
+	// A pinned badge has no others to fall back to.
+	attempts := len(candidates)
+	if pinned != "" {
+		attempts = 1
+	}
+	badge, ok := locateChosenBadge(w, r, pool, attempts, choose)
+	if !ok {
+		return
+	}
+	requestLog(r).Debug("serving badge", "slot", slot, "seed", baseSeed, "filename", badge.name)
+	writeBadge(w, r, badge, baseSeed, true)
+}
+
+// chooseBadge returns the badge choose selects from pool, writing an error
+// response and returning false when it selects none or an unsafe name.
+func chooseBadge(w http.ResponseWriter, r *http.Request, pool []string, choose func(pool []string) (string, error)) (string, bool) {
+	selectedFilename, err := choose(pool)
+	if err != nil {
+		requestLog(r).Error("could not select badge", "error", err)
+		badgeErrorsTotal.inc("selection")
+		writeError(w, r, "Error selecting badge", http.StatusInternalServerError)
+		return "", false
+	}
+	if !checkBadgeFilename(w, r, selectedFilename) {
+		return "", false
+	}
+	return selectedFilename, true
+}
+
+// locateChosenBadge locates the badge choose selects from pool. A badge
+// deleted since discovery is dropped from pool and choose asked again, at
+// most attempts times in all, so one missing file doesn't fail the request
+// while others are still there. It writes an error response and returns
+// false when no badge can be located.
+func locateChosenBadge(w http.ResponseWriter, r *http.Request, pool []string, attempts int, choose func(pool []string) (string, error)) (locatedBadge, bool) {
+	for ; ; attempts-- {
+		selectedFilename, ok := chooseBadge(w, r, pool, choose)
+		if !ok {
+			return locatedBadge{}, false
+		}
+		badge, err := locateBadge(selectedFilename)
+		if err == nil {
+			return badge, true
+		}
+		if !errors.Is(err, fs.ErrNotExist) || attempts <= 1 {
+			requestLog(r).Error("could not read badge", "filename", selectedFilename, "error", err)
+			badgeErrorsTotal.inc("not_found")
+			writeError(w, r, "Badge not found", http.StatusNotFound)
+			return locatedBadge{}, false
+		}
+		requestLog(r).Warn("badge removed since discovery, selecting another", "filename", selectedFilename)
+		mu.Lock()
+		discoverInBackgroundLocked()
+		mu.Unlock()
+		pool = slices.DeleteFunc(slices.Clone(pool), func(name string) bool {
+			return name == selectedFilename
+		})
+	}
+}
+
+// checkBadgeFilename validates a selected badge name, replying with a 500
+// and returning false when it is unsafe to serve.
+func checkBadgeFilename(w http.ResponseWriter, r *http.Request, name string) bool {
+	if err := validateBadgeFilename(name); err != nil {
+		requestLog(r).Error("refusing to serve badge", "filename", name, "error", err)
+		badgeErrorsTotal.inc("invalid_filename")
+		writeError(w, r, "Invalid badge filename", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// randomBadgeHandler serves /random.gif, a uniformly random badge from the
+// group and format query parameters on every request, ignoring slots, seeds,
+// weights and the rotation window.
+func randomBadgeHandler(w http.ResponseWriter, r *http.Request) {
+	rediscoverIfStale()
+
+	snapshot := snapshotBadges()
+	w.Header().Set("X-Badge-Count", strconv.Itoa(len(snapshot.files)))
+	if len(snapshot.files) == 0 {
+		serveNoBadges(w, r)
+		return
+	}
+	if len(snapshot.files) < minBadges {
+		serveTooFewBadges(w, r, len(snapshot.files))
+		return
+	}
+	candidates := snapshot.candidates(r.URL.Query().Get("group"), r.URL.Query().Get("format"))
+	badge, ok := locateChosenBadge(w, r, candidates, len(candidates), func(pool []string) (string, error) {
+		return pool[rand.Intn(len(pool))], nil
 	})
+	if !ok {
+		return
+	}
+	requestLog(r).Debug("serving random badge", "filename", badge.name)
+	writeBadge(w, r, badge, 0, false)
+}
+
+// fileBadgeHandler serves /badge/{filename}, the named badge outside of
+// rotation. Only discovered badges are served, so the name is checked
+// against the badge list and never joined onto badgesDir as given.
+func fileBadgeHandler(w http.ResponseWriter, r *http.Request) {
+	rediscoverIfStale()
+
+	name := r.PathValue("filename")
+	if !slices.Contains(snapshotBadges().files, name) {
+		requestLog(r).Debug("requested badge is not discovered", "filename", name)
+		badgeErrorsTotal.inc("not_found")
+		writeError(w, r, "Badge not found", http.StatusNotFound)
+		return
+	}
+	if !checkBadgeFilename(w, r, name) {
+		return
+	}
+	if redirectBase != "" {
+		redirectToBadge(w, r, name)
+		return
+	}
+	badge, err := locateBadge(name)
 	if err != nil {
-		log.Printf("Error during badge discovery: %v\n", err)
+		requestLog(r).Error("could not read badge", "filename", name, "error", err)
+		badgeErrorsTotal.inc("not_found")
+		writeError(w, r, "Badge not found", http.StatusNotFound)
 		return
 	}
-	if len(discovered) > 0 {
-		sort.Strings(discovered)
-		badgeFilesList = discovered
-		log.Printf("Discovered %d badges (GIFs and PNGs): %v\n", len(badgeFilesList), badgeFilesList)
+	requestLog(r).Debug("serving badge by name", "filename", name)
+	writeBadge(w, r, badge, 0, false)
+}
+
+// writeBadge serves badge with the processing its query asks for. With
+// seeded set the response carries an ETag for baseSeed's rotation window and
+// honours If-None-Match.
+func writeBadge(w http.ResponseWriter, r *http.Request, badge locatedBadge, baseSeed int64, seeded bool) {
+	noteServedBadge(r, badge.name)
+	if !waitDebugDelay(r) {
+		return
+	}
+	selectedFilename, filePath, modTime := badge.name, badge.path, badge.modTime
+	variant, process, err := badgeProcessing(selectedFilename, r.URL.Query())
+	if err != nil {
+		badgeErrorsTotal.inc("invalid_processing")
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if contentTypeFor(selectedFilename) == svgContentType {
+		// Opened on its own, an SVG is a document that can run script and
+		// load resources, so it gets a policy allowing neither.
+		w.Header().Set("Content-Security-Policy", svgContentSecurityPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	compressible := isCompressible(contentTypeFor(selectedFilename))
+	if compressible {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	gzipped := compressible && acceptsGzip(r)
+
+	if !seeded {
+		setNoCacheHeaders(w)
 	} else {
-		log.Println("No .gif or .png badges found.")
-		badgeFilesList = []string{}
+		setRotationCacheHeaders(w)
+		etag := badgeETag(selectedFilename, variant, baseSeed)
+		if gzipped {
+			// The gzipped body is a different representation, so caches
+			// must not answer a request without gzip from it.
+			etag = strings.TrimSuffix(etag, `"`) + `-gz"`
+		}
+		w.Header().Set("ETag", etag)
+		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 	}
-	lastDiscoveryTime = time.Now()
+
+	if badgeBytes == nil && process == nil && !gzipped && !isRemoteBadgePath(filePath) {
+		contentType, err := sniffBadgeFile(selectedFilename, filePath)
+		if err != nil {
+			requestLog(r).Error("could not read badge", "filename", selectedFilename, "error", err)
+			badgeErrorsTotal.inc("read_error")
+			writeError(w, r, "Error reading badge", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", servedContentType(selectedFilename, contentType))
+		recordServe(selectedFilename)
+		http.ServeFileFS(w, r, badgeFS, filePath)
+		return
+	}
+	var data []byte
+	if process == nil {
+		data, err = readBadge(selectedFilename, filePath, modTime)
+	} else {
+		data, err = processedBadge(selectedFilename, filePath, modTime, variant, process)
+	}
+	if err != nil {
+		requestLog(r).Error("could not read badge", "filename", selectedFilename, "error", err)
+		badgeErrorsTotal.inc("read_error")
+		writeError(w, r, "Error reading badge", http.StatusInternalServerError)
+		return
+	}
+	outputName := selectedFilename
+	if process != nil {
+		outputName = servedName(selectedFilename, data)
+	}
+	w.Header().Set("Content-Type", servedContentType(outputName, detectContentType(outputName, data)))
+	if gzipped {
+		if data, err = gzippedBadge(selectedFilename, modTime, variant, data); err != nil {
+			requestLog(r).Error("could not compress badge", "filename", selectedFilename, "error", err)
+			badgeErrorsTotal.inc("read_error")
+			writeError(w, r, "Error reading badge", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	recordServe(selectedFilename)
+	http.ServeContent(w, r, path.Base(outputName), modTime, bytes.NewReader(data))
 }
 
-func selectBadgeForSlot(availableBadges []string, baseSeed int64, slot int) (string, []string) {
-	if len(availableBadges) == 0 {
-		return "", availableBadges
+// isCompressible reports whether badges of contentType are worth gzipping.
+// Raster formats are already compressed.
+func isCompressible(contentType string) bool {
+	return contentType == svgContentType
+}
+
+// acceptsGzip reports whether r's Accept-Encoding allows gzip: its q value
+// is above 0, from a gzip entry or, when there is none, from "*".
+func acceptsGzip(r *http.Request) bool {
+	quality, explicit := 0.0, false
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && (name != "*" || explicit) {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		quality, explicit = q, name == "gzip"
 	}
+	return quality > 0
+}
 
-	r := rand.New(rand.NewSource(baseSeed + int64(slot)))
+type badgeListResponse struct {
+	Badges            []string  `json:"badges"`
+	Count             int       `json:"count"`
+	LastDiscoveryTime time.Time `json:"lastDiscoveryTime"`
+	// Dimensions is set only with RECORD_DIMENSIONS=1.
+	Dimensions map[string]badgeSize `json:"dimensions,omitempty"`
+}
 
-	idxToPick := r.Intn(len(availableBadges))
-	selected := availableBadges[idxToPick]
+func badgesJSONHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	badges := currentBadgeFiles()
+	discoveredAt := lastDiscoveryTime
+	dimensions := badgeDimensions
+	mu.Unlock()
 
-	remainingBadges := make([]string, 0, len(availableBadges)-1)
-	remainingBadges = append(remainingBadges, availableBadges[:idxToPick]...)
-	remainingBadges = append(remainingBadges, availableBadges[idxToPick+1:]...)
+	body, err := json.Marshal(badgeListResponse{
+		Badges:            badges,
+		Count:             len(badges),
+		LastDiscoveryTime: discoveredAt,
+		Dimensions:        dimensions,
+	})
+	if err != nil {
+		requestLog(r).Error("could not encode badge list", "error", err)
+		writeError(w, r, "Error encoding badge list", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
 
-	return selected, remainingBadges
+type reloadResponse struct {
+	Count             int       `json:"count"`
+	LastDiscoveryTime time.Time `json:"lastDiscoveryTime"`
 }
 
-func badgeHandler(w http.ResponseWriter, r *http.Request) {
+// reloadHandler serves POST /reload, rediscovering badges before it responds
+// with the new count. Concurrent reloads share discoveries rather than
+// stacking them, and requests keep serving the previous list meanwhile.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	discoverBadgesAndWait()
+
 	mu.Lock()
-	if time.Since(lastDiscoveryTime) > discoveryInterval {
-		mu.Unlock()
-		discoverBadges()
-		mu.Lock()
+	response := reloadResponse{Count: len(currentBadgeFiles()), LastDiscoveryTime: lastDiscoveryTime}
+	mu.Unlock()
+	body, err := json.Marshal(response)
+	if err != nil {
+		requestLog(r).Error("could not encode reload response", "error", err)
+		writeError(w, r, "Error encoding reload response", http.StatusInternalServerError)
+		return
 	}
+	requestLog(r).Info("reloaded badges", "count", response.Count)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
 
-	if len(badgeFilesList) == 0 {
-		mu.Unlock()
-		log.Println("No badges available to serve.")
-		http.Error(w, "No badges available", http.StatusNotFound)
+// countHandler returns the number of discovered badges as plain text.
+func countHandler(w http.ResponseWriter, r *http.Request) {
+	count := len(currentBadgeFiles())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, count)
+}
+
+type previewResponse struct {
+	Slot     int    `json:"slot"`
+	Seed     int64  `json:"seed"`
+	Filename string `json:"filename"`
+}
+
+// previewHandler reports which badge /badge.gif would serve for the given
+// slot, group, format and seed without serving the image. seed defaults to
+// the current rotation window.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	sel, ok := selectForPreview(w, r, false)
+	if !ok {
 		return
 	}
 
-	currentAvailableBadges := make([]string, len(badgeFilesList))
-	copy(currentAvailableBadges, badgeFilesList)
-	mu.Unlock()
+	body, err := json.Marshal(previewResponse{
+		Slot:     sel.slot,
+		Seed:     sel.seed,
+		Filename: sel.filename,
+	})
+	if err != nil {
+		requestLog(r).Error("could not encode preview response", "error", err)
+		writeError(w, r, "Error encoding preview response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
 
-	timeWindowSeconds := 2
-	baseSeed := time.Now().Unix() / int64(timeWindowSeconds)
+// previewSelection is the badge a request for a slot selects, as
+// /badge.gif would select it, and what it was selected from. A handler that
+// serves the badge passes pool, attempts and choose to locateChosenBadge, so
+// a badge deleted since discovery is replaced as serveBadge replaces it.
+type previewSelection struct {
+	snapshot badgeSnapshot
+	slot     int
+	seed     int64
+	filename string
+	pool     []string
+	attempts int
+	choose   func(pool []string) (string, error)
+}
 
-	slotStr := r.URL.Query().Get("slot")
-	slot, err := strconv.Atoi(slotStr)
-	if err != nil || slot < 1 || slot > numBadgeSlots {
-		log.Printf("Invalid or missing slot parameter '%s', defaulting to behavior for slot 1\n", slotStr)
-		slot = 1
+// selectForPreview selects the badge r's slot, group, format, seed, key, ns
+// and name parameters pick, without locating or serving it. Like serveBadge
+// it rediscovers a stale badge list, refuses to select below MIN_BADGES and,
+// with ROTATION_MODE=session, follows the client's session: serving, for a
+// handler that serves the badge, advances it as /badge.gif does, and
+// otherwise the badge /badge.gif would serve next is reported. It writes an
+// error response and returns false when the request can't select one.
+func selectForPreview(w http.ResponseWriter, r *http.Request, serving bool) (previewSelection, bool) {
+	rediscoverIfStale()
+
+	snapshot := snapshotBadges()
+	if len(snapshot.files) == 0 {
+		rediscoverIfEmpty()
+		writeError(w, r, "No badges available", http.StatusNotFound)
+		return previewSelection{}, false
+	}
+	if len(snapshot.files) < minBadges {
+		serveTooFewBadges(w, r, len(snapshot.files))
+		return previewSelection{}, false
 	}
 
-	var selectedFilename string
-	tempIndices := make([]int, len(currentAvailableBadges))
-	for i := range tempIndices {
-		tempIndices[i] = i
+	baseSeed, err := resolveSeed(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return previewSelection{}, false
 	}
-	shuffleRand := rand.New(rand.NewSource(baseSeed))
-	shuffleRand.Shuffle(len(tempIndices), func(i, j int) {
-		tempIndices[i], tempIndices[j] = tempIndices[j], tempIndices[i]
-	})
 
-	effectiveSlotIndex := (slot - 1) % len(tempIndices)
-	if effectiveSlotIndex < len(tempIndices) {
-		selectedFilename = currentAvailableBadges[tempIndices[effectiveSlotIndex]]
-	} else {
-		if len(currentAvailableBadges) > 0 {
-			selectedFilename = currentAvailableBadges[0]
-			log.Printf("Warning: Effective slot index out of bounds, serving first available badge.")
+	slot := parseSlot(r.URL.Query().Get("slot"))
+	var pinned string
+	if name := r.URL.Query().Get("name"); name != "" {
+		slot, pinned = snapshot.resolveAlias(r, name)
+	}
+	format := r.URL.Query().Get("format")
+	pool := snapshot.candidates(r.URL.Query().Get("group"), "")
+	count := len(narrowToFormat(pool, format))
+	if pinned == "" {
+		if r.URL.Query().Get("name") == "" {
+			if err := checkStrictSlot(r.URL.Query().Get("slot"), count); err != nil {
+				writeError(w, r, err.Error(), http.StatusBadRequest)
+				return previewSelection{}, false
+			}
+		}
+		if err := checkTotalSlots(r.URL.Query().Get("slots"), slot, count); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return previewSelection{}, false
+		}
+	}
+	if rotationMode == "session" && !hasExplicitSeed(r.URL.Query()) {
+		if serving {
+			baseSeed = advanceSession(w, r)
 		} else {
-			log.Println("Error: No badges available after attempting slot selection.")
-			http.Error(w, "Error selecting badge", http.StatusInternalServerError)
-			return
+			baseSeed = peekSession(w, r)
+		}
+	}
+
+	sel := previewSelection{snapshot: snapshot, slot: slot, seed: baseSeed, pool: pool, attempts: count}
+	sel.choose = func(pool []string) (string, error) {
+		if pinned != "" {
+			return pinned, nil
+		}
+		return snapshot.pick(pool, format, baseSeed, slot)
+	}
+	if pinned != "" {
+		sel.attempts = 1
+	}
+	sel.filename, err = sel.choose(pool)
+	if err != nil {
+		writeError(w, r, "Error selecting badge", http.StatusInternalServerError)
+		return previewSelection{}, false
+	}
+	return sel, true
+}
+
+type badgeMetaResponse struct {
+	Slot     int    `json:"slot"`
+	Filename string `json:"filename"`
+	badgeMeta
+}
+
+// badgeMetaHandler serves /badge-meta, the sidecar metadata of the badge a
+// slot currently shows. Badges without a sidecar have empty metadata.
+func badgeMetaHandler(w http.ResponseWriter, r *http.Request) {
+	sel, ok := selectForPreview(w, r, false)
+	if !ok {
+		return
+	}
+	body, err := json.Marshal(badgeMetaResponse{
+		Slot:      sel.slot,
+		Filename:  sel.filename,
+		badgeMeta: sel.snapshot.metadata[sel.filename],
+	})
+	if err != nil {
+		requestLog(r).Error("could not encode badge metadata", "error", err)
+		writeError(w, r, "Error encoding badge metadata", http.StatusInternalServerError)
+		return
+	}
+	setRotationCacheHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// version, commit and buildTime describe the build, set with
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When not injected they read "dev", except in binaries built from a
+// checkout, where commit and buildTime fall back to the revision and commit
+// time the go command stamps in.
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildTime = "dev"
+)
+
+type versionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+}
+
+// buildVersion describes the running build, falling back to the module's
+// VCS settings for values not stamped in with -ldflags.
+func buildVersion() versionResponse {
+	info := versionResponse{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "dev":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildTime == "dev":
+				info.BuildTime = setting.Value
+			}
 		}
 	}
+	return info
+}
 
-	filePath := filepath.Join(badgesDir, selectedFilename)
-	log.Printf("Slot %d (TimeSeed %d): Serving badge: %s\n", slot, baseSeed, filePath)
+// versionHandler reports which build is running.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(buildVersion())
+	if err != nil {
+		requestLog(r).Error("could not encode version response", "error", err)
+		writeError(w, r, "Error encoding version response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
 
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, public, max-age=0")
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
+type healthResponse struct {
+	Status            string    `json:"status"`
+	Uptime            string    `json:"uptime"`
+	Badges            int       `json:"badges"`
+	LastDiscoveryTime time.Time `json:"lastDiscoveryTime"`
+}
 
-	if strings.HasSuffix(strings.ToLower(selectedFilename), ".png") {
-		w.Header().Set("Content-Type", "image/png")
-	} else {
-		w.Header().Set("Content-Type", "image/gif")
+// healthzHandler reports health, returning 503 while no badges have been
+// discovered, since every badge request would fail. With ?ready=1 it acts as
+// a stricter readiness probe and returns 503 until at least minBadges badges
+// have been discovered.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	count := len(currentBadgeFiles())
+	discoveredAt := lastDiscoveryTime
+	mu.Unlock()
+
+	status := http.StatusOK
+	health := healthResponse{
+		Status:            "ok",
+		Uptime:            time.Since(startTime).Round(time.Second).String(),
+		Badges:            count,
+		LastDiscoveryTime: discoveredAt,
+	}
+	if count == 0 || (r.URL.Query().Get("ready") == "1" && count < minBadges) {
+		status = http.StatusServiceUnavailable
+		health.Status = "no badges"
+		if count > 0 {
+			health.Status = "too few badges"
+		}
+	}
+
+	body, err := json.Marshal(health)
+	if err != nil {
+		requestLog(r).Error("could not encode health response", "error", err)
+		writeError(w, r, "Error encoding health response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+const defaultRootMessage = "Go Animated Badge Rotator (Slot-based). Use /badge.gif?slot=1, /badge.gif?slot=2, etc., or /badge.png for PNG badges only."
+
+// rootMessage is the text rootHandler answers with, from ROOT_MESSAGE.
+var rootMessage = defaultRootMessage
+
+func resolveRootMessage() string {
+	if message := strings.TrimSpace(os.Getenv("ROOT_MESSAGE")); message != "" {
+		return message
 	}
-	http.ServeFile(w, r, filePath)
+	return defaultRootMessage
+}
+
+type rootResponse struct {
+	Message string `json:"message"`
+	Badges  int    `json:"badges"`
+	Uptime  string `json:"uptime"`
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
 }
 
+// rootHandler describes the service with rootMessage as one line of text. It
+// renders the contact sheet for browsers that rank HTML above plain text, and
+// reports the message with the badge count, uptime and version as JSON for
+// clients that prefer application/json, so the root can serve as a status
+// page.
 func rootHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "Go Animated Badge Rotator (Slot-based). Use /badge.gif?slot=1, /badge.gif?slot=2, etc.")
+	accept := r.Header.Get("Accept")
+	w.Header().Add("Vary", "Accept")
+	if acceptQuality(accept, "application/json") > max(acceptQuality(accept, "text/html"), acceptQuality(accept, "text/plain")) {
+		info := buildVersion()
+		body, err := json.Marshal(rootResponse{
+			Message: rootMessage,
+			Badges:  len(currentBadgeFiles()),
+			Uptime:  time.Since(startTime).Round(time.Second).String(),
+			Version: info.Version,
+			Commit:  info.Commit,
+		})
+		if err != nil {
+			requestLog(r).Error("could not encode root response", "error", err)
+			writeError(w, r, "Error encoding root response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+		return
+	}
+	if acceptQuality(accept, "text/html") > acceptQuality(accept, "text/plain") {
+		contactSheetHandler(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, rootMessage)
+}
+
+// faviconHandler answers the /favicon.ico request browsers make on their
+// own with 204, so it doesn't fall through to rootHandler. Browsers cache
+// the answer for a day.
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func main() {
+	discoverOnly := flag.Bool("discover", false, "discover badges once, print what was found and skipped, and exit")
+	flag.Parse()
+
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: resolveLogLevel()})))
+	badgesDir = resolveBadgesDir()
+	badgesURL = strings.TrimSpace(os.Getenv("BADGES_URL"))
+	badgeFS = os.DirFS(badgesDir)
+	if badgesURL != "" {
+		slog.Info("using remote badge index", "url", badgesURL)
+	} else if embeddedBadges != nil {
+		badgeFS = embeddedBadges
+		slog.Info("using badges embedded in the binary, BADGES_DIR is ignored")
+	} else {
+		slog.Info("using badges directory", "dir", badgesDir)
+		if err := checkBadgesDir(); err != nil {
+			// Vercel bundles files at paths that can differ from local runs,
+			// so there a bad directory is warned about rather than fatal.
+			wd, _ := os.Getwd()
+			if os.Getenv("VERCEL") == "1" {
+				slog.Warn("badges directory is not usable, no badges will be served", "dir", badgesDir, "workingDir", wd, "error", err)
+			} else {
+				slog.Error("badges directory is not usable, set BADGES_DIR to an existing directory", "dir", badgesDir, "workingDir", wd, "error", err)
+				os.Exit(1)
+			}
+		}
+	}
+	// Discovery's own settings come first, so -discover can print what
+	// discovery finds before anything else is set up, such as CACHE_DIR.
+	excludePattern = resolveExcludePattern()
+	badgeOrder = resolveBadgeOrder()
+	maxBadgeBytes = resolveMaxBadgeBytes()
+	newestN = resolveNewestN()
+	dedupeBadges = os.Getenv("DEDUPE") == "1"
+	if dedupeBadges && badgesURL != "" {
+		slog.Warn("DEDUPE only applies to local badges, ignoring it for BADGES_URL")
+	}
+	recordDimensions = os.Getenv("RECORD_DIMENSIONS") == "1"
+	featuredBadge = strings.TrimSpace(os.Getenv("FEATURED_BADGE"))
+	if featuredBadge != "" {
+		slog.Info("featuring badge in slot 1", "filename", featuredBadge)
+	}
+	disabledFile = resolveDisabledFile()
+	disabledBadges = loadDisabled()
+	if *discoverOnly {
+		discoverBadges()
+		printDiscovery(os.Stdout)
+		return
+	}
+
+	addr, err := resolveListenAddr()
+	if err != nil {
+		slog.Error("invalid LISTEN_ADDR, expected host:port such as 127.0.0.1:8080 or :9000", "value", os.Getenv("LISTEN_ADDR"), "error", err)
+		os.Exit(1)
+	}
+	rotationWindowSeconds = resolveRotationWindow()
+	rotationMode = resolveRotationMode()
+	newStrategy = rotationModes[rotationMode]
+	switch rotationMode {
+	case "daily":
+		rotationLocation = resolveRotationLocation()
+		slog.Info("rotating daily", "timezone", rotationLocation.String())
+	case "fixed":
+		slog.Info("rotation disabled, slots map to badges in order")
+	case "session":
+		slog.Info("rotating per client session, each request serves the next badge")
+	default:
+		slog.Info("rotation window configured", "seconds", rotationWindowSeconds)
+	}
+	cacheWindow = resolveCacheWindow()
+	if cacheWindow && rotationMode == "session" {
+		slog.Warn("CACHE_MODE=window would let caches repeat a session's badge, using nocache")
+		cacheWindow = false
+	}
+	if cacheWindow {
+		slog.Info("caching badges until the rotation window ends")
+	}
+	discoveryInterval = resolveDiscoveryInterval()
+	discoveryStaleAfter = jitterInterval(discoveryInterval, resolveDiscoveryJitter())
+	slog.Info("discovery interval configured", "interval", discoveryInterval.String(), "jittered", discoveryStaleAfter.Round(time.Second).String())
+	badgeBytes = resolveBadgeCache()
+	if badgeBytes == nil {
+		slog.Info("badge cache disabled")
+	} else {
+		slog.Info("badge cache enabled", "maxBytes", badgeBytes.maxBytes)
+	}
+	if badgeBytes != nil {
+		diskBadges = resolveDiskCache(badgeBytes.maxBytes)
+	}
+	if diskBadges != nil {
+		slog.Info("caching processed badges on disk", "dir", diskBadges.dir)
+	}
+	servePlaceholder = os.Getenv("PLACEHOLDER_BADGE") != "0"
+	corsOrigin = resolveCORSOrigin()
+	badgeRateLimiter = resolveRateLimiter()
+	if badgeRateLimiter != nil {
+		slog.Info("rate limiting badge requests", "rps", badgeRateLimiter.rate, "burst", badgeRateLimiter.burst)
+	}
+	minFrameDelay = resolveMinFrameDelay()
+	if minFrameDelay > 0 {
+		slog.Info("clamping GIF frame delays", "minDelayMs", minFrameDelay*10)
+	}
+	maxResizeDimension = resolveMaxResizeDimension()
+	instanceSalt = resolveInstanceSalt()
+	debugEndpoints = resolveDebugEndpoints()
+	debugDelay = resolveDebugDelay()
+	if debugDelay > 0 {
+		slog.Warn("delaying every badge response, unset DEBUG_DELAY outside development", "delay", debugDelay.String())
+	}
+	maxDataURIBytes = resolveMaxDataURIBytes()
+	maxBatchBytes = resolveMaxBatchBytes()
+	mimeOverrides = resolveMIMEOverrides()
+	redirectBase = resolveRedirectBase()
+	if redirectBase != "" {
+		slog.Info("redirecting badge requests", "base", redirectBase)
+	}
+	if len(mimeOverrides) > 0 {
+		slog.Info("overriding badge content types", "overrides", mimeOverrides)
+	}
+	minBadges = resolveMinBadges()
+	serveTimeout = resolveServeTimeout()
+	slowRequestThreshold = resolveSlowRequestThreshold()
+	rootMessage = resolveRootMessage()
+	if serveTimeout > 0 {
+		slog.Info("badge requests time out", "timeout", serveTimeout.String())
+	}
+	if minBadges > 1 {
+		slog.Info("serving badges once enough are discovered", "minBadges", minBadges)
+	}
+	strictSlot = os.Getenv("STRICT_SLOT") == "1"
+	if strictSlot {
+		slog.Info("rejecting missing and out-of-range slots")
+	}
+	adminCredentials = resolveAdminCredentials()
+	if adminCredentials != nil {
+		slog.Info("administrative endpoints require basic auth")
+	}
 	discoverBadges()
-	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/badge.gif", badgeHandler)
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = defaultPort
+	if os.Getenv("PRELOAD") == "1" {
+		go preloadBadges()
+	}
+	var watcher io.Closer
+	if os.Getenv("WATCH_BADGES") == "1" && embeddedBadges == nil {
+		badgeWatcher, err := startBadgeWatcher()
+		if err != nil {
+			slog.Error("could not start badge watcher, falling back to periodic discovery", "error", err)
+		} else {
+			watcher = badgeWatcher
+			slog.Info("watching for badge changes", "dir", badgesDir)
+		}
+	}
+	http.HandleFunc("/", withReadOnly(rootHandler))
+	http.HandleFunc("/favicon.ico", withReadOnly(faviconHandler))
+	http.HandleFunc("/badge.gif", withCORS(withReadOnly(withRateLimit(withSlowRequestLog(withServeTimeout(newBadgeHandler("")))))))
+	http.HandleFunc("/badge.png", withCORS(withReadOnly(withRateLimit(withSlowRequestLog(withServeTimeout(newBadgeHandler("png")))))))
+	http.HandleFunc("/badge.datauri", withCORS(withReadOnly(withRateLimit(withSlowRequestLog(withServeTimeout(dataURIHandler))))))
+	http.HandleFunc("/badge/{filename...}", withCORS(withReadOnly(withRateLimit(withSlowRequestLog(withServeTimeout(fileBadgeHandler))))))
+	http.HandleFunc("/random.gif", withCORS(withReadOnly(withRateLimit(withSlowRequestLog(withServeTimeout(randomBadgeHandler))))))
+	http.HandleFunc("/badges.json", withCORS(withReadOnly(badgesJSONHandler)))
+	http.HandleFunc("/badges-strip.gif", withCORS(withReadOnly(withRateLimit(withSlowRequestLog(withServeTimeout(stripHandler))))))
+	http.HandleFunc("/badges-batch", withCORS(withReadOnly(withRateLimit(withSlowRequestLog(withServeTimeout(batchHandler))))))
+	http.HandleFunc("/count", withCORS(withReadOnly(countHandler)))
+	http.HandleFunc("/healthz", withReadOnly(healthzHandler))
+	http.HandleFunc("/version", withReadOnly(versionHandler))
+	http.HandleFunc("/preview", withReadOnly(previewHandler))
+	http.HandleFunc("/overlay", withReadOnly(overlayHandler))
+	http.HandleFunc("/badge-meta", withCORS(withReadOnly(badgeMetaHandler)))
+	http.HandleFunc("/stats", withReadOnly(statsHandler))
+	http.HandleFunc("/metrics", withReadOnly(withAdminAuth(metricsHandler)))
+	http.HandleFunc("/reload", withAdminAuth(reloadHandler))
+	http.HandleFunc("/disable", withAdminAuth(disableHandler))
+	http.HandleFunc("/enable", withAdminAuth(enableHandler))
+	if debugEndpoints {
+		http.HandleFunc("/debug/slots", withReadOnly(withAdminAuth(debugSlotsHandler)))
+		http.HandleFunc("/debug/discovery", withReadOnly(withAdminAuth(debugDiscoveryHandler)))
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("failed to start server", "addr", addr, "error", err)
+		os.Exit(1)
+	}
+
+	server := &http.Server{Handler: withRequestID(http.DefaultServeMux.ServeHTTP)}
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting Go Slot-based Animated Badge Rotator server", "addr", listener.Addr().String())
+		serverErr <- server.Serve(listener)
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		slog.Error("failed to start server", "error", err)
+		os.Exit(1)
+	case sig := <-stop:
+		slog.Info("shutting down", "signal", sig.String())
+	}
+
+	if watcher != nil {
+		watcher.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("error during shutdown", "error", err)
 	}
-	log.Printf("Starting Go Slot-based Animated Badge Rotator server on port %s...\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Failed to start server: %v\n", err)
+	// A discovery started by a request or the watcher may still be walking
+	// badgesDir or pruning the disk cache.
+	if err := awaitDiscovery(ctx); err != nil {
+		slog.Error("discovery still running at shutdown", "error", err)
 	}
+	slog.Info("server stopped")
 }
@@ -0,0 +1,1221 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// runMain re-runs the test binary as the server itself.
+	if os.Getenv("BADGE_ROTATOR_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// runMain runs main in a new process with args and the environment env on
+// top of the test's, and returns what it printed to stdout.
+func runMain(t *testing.T, env []string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), "BADGE_ROTATOR_RUN_MAIN=1"), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("running main %v: %v\n%s", args, err, stderr.Bytes())
+	}
+	return string(out)
+}
+
+// testGIF returns a w x h GIF with frames frames, each a different colour so
+// re-encoding can't merge them.
+func testGIF(t testing.TB, w, h, frames int) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White, color.RGBA{R: 255, A: 255}, color.RGBA{G: 255, A: 255}}
+	g := &gif.GIF{}
+	for i := range frames {
+		frame := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i % len(palette))
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 2)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testPNG returns a w x h opaque PNG.
+func testPNG(t testing.TB, w, h int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for p := range img.Pix {
+		img.Pix[p] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// useBadges points discovery at a temporary directory holding files and runs
+// it, restoring the previous badge state when the test ends. Tests using it
+// must not run in parallel, since the badge state is global.
+func useBadges(t testing.TB, files map[string][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prevDir, prevFS, prevCache := badgesDir, badgeFS, badgeBytes
+	t.Cleanup(func() {
+		waitForDiscovery()
+		badgesDir, badgeFS, badgeBytes = prevDir, prevFS, prevCache
+		resetDiscovery()
+	})
+	badgesDir, badgeFS, badgeBytes = dir, os.DirFS(dir), nil
+	resetDiscovery()
+	discoverBadges()
+	return dir
+}
+
+// resetDiscovery forgets everything earlier discoveries and requests
+// recorded, so the next discovery starts from scratch.
+func resetDiscovery() {
+	mu.Lock()
+	badgeState.Store(nil)
+	badgeDimensions = nil
+	discoverySkipped, remoteBadges = nil, nil
+	discoverySignature = dirSignature{}
+	lastDiscoveryTime = time.Time{}
+	// Requests that find no badges would otherwise start discoveries that
+	// outlive the test.
+	lastEmptyRediscover = time.Now()
+	corruptBadges = make(map[string]time.Time)
+	disabledBadges = make(map[string]bool)
+	mu.Unlock()
+}
+
+// waitForDiscovery waits for a discovery started in the background to finish.
+func waitForDiscovery() {
+	mu.Lock()
+	done := discoveryDone
+	mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// setForTest sets *p to value until the test ends.
+func setForTest[T any](t testing.TB, p *T, value T) {
+	t.Helper()
+	prev := *p
+	*p = value
+	t.Cleanup(func() { *p = prev })
+}
+
+// get serves a GET of target through handler.
+func get(t testing.TB, handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestAwaitDiscovery(t *testing.T) {
+	useBadges(t, nil)
+	if err := awaitDiscovery(context.Background()); err != nil {
+		t.Errorf("with no discovery running: %v", err)
+	}
+
+	done := make(chan struct{})
+	mu.Lock()
+	discoveryDone = done
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		discoveryDone = nil
+		mu.Unlock()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := awaitDiscovery(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("with discovery stuck: %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(done)
+	if err := awaitDiscovery(context.Background()); err != nil {
+		t.Errorf("after discovery finished: %v", err)
+	}
+}
+
+func TestRediscoverIfStaleStartsOneWalk(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	mu.Lock()
+	lastDiscoveryTime = time.Now().Add(-2 * discoveryStaleAfter)
+	mu.Unlock()
+
+	rediscoverIfStale()
+	mu.Lock()
+	started := discovering || !lastDiscoveryTime.Before(time.Now().Add(-discoveryStaleAfter))
+	mu.Unlock()
+	if !started {
+		t.Fatal("rediscoverIfStale returned without marking a discovery as running")
+	}
+	for range 20 {
+		rediscoverIfStale()
+	}
+	mu.Lock()
+	again := rediscover
+	mu.Unlock()
+	waitForDiscovery()
+	if again {
+		t.Fatal("stale requests made the running discovery walk again")
+	}
+}
+
+func TestResolveSeedNamespaceKeepsWindowsConsecutive(t *testing.T) {
+	sequence := []string{"one.gif", "two.gif", "three.gif"}
+	s := badgeSnapshot{files: sequence, sequence: sequence}
+	var previous string
+	for window := int64(500); window < 507; window++ {
+		seed, err := resolveSeed(url.Values{"seed": {strconv.FormatInt(window, 10)}, "ns": {"docs-site"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		unspaced, _ := resolveSeed(url.Values{"seed": {strconv.FormatInt(window, 10)}})
+		if seed == unspaced {
+			t.Fatalf("window %d: ns left the seed unchanged", window)
+		}
+		got, err := s.pick(s.candidates("", ""), "", seed, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if previous != "" {
+			if want := sequence[(slices.Index(sequence, previous)+1)%len(sequence)]; got != want {
+				t.Fatalf("window %d gave %q after %q, want %q", window, got, previous, want)
+			}
+		}
+		previous = got
+	}
+}
+
+func TestDailyWindowSeedIsContiguous(t *testing.T) {
+	setForTest(t, &rotationMode, "daily")
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, loc := range []*time.Location{time.UTC, newYork} {
+		setForTest(t, &rotationLocation, loc)
+		// Noon each day through a month end, a year end, a leap day and
+		// both DST changes.
+		for _, start := range []time.Time{
+			time.Date(2025, 1, 29, 12, 0, 0, 0, loc),
+			time.Date(2025, 12, 30, 12, 0, 0, 0, loc),
+			time.Date(2024, 2, 27, 12, 0, 0, 0, loc),
+			time.Date(2025, 3, 8, 12, 0, 0, 0, loc),
+			time.Date(2025, 11, 1, 12, 0, 0, 0, loc),
+		} {
+			previous := windowSeed(start)
+			for day := 1; day <= 4; day++ {
+				seed := windowSeed(start.AddDate(0, 0, day))
+				if seed != previous+1 {
+					t.Fatalf("%s: seed for %s is %d, want %d", loc, start.AddDate(0, 0, day).Format(time.DateOnly), seed, previous+1)
+				}
+				previous = seed
+			}
+		}
+	}
+	if late, early := windowSeed(time.Date(2025, 6, 1, 23, 59, 0, 0, newYork)), windowSeed(time.Date(2025, 6, 1, 0, 1, 0, 0, newYork)); late != early {
+		t.Fatalf("seeds within one day differ: %d and %d", early, late)
+	}
+}
+
+func decodeGIF(t testing.TB, data []byte) *gif.GIF {
+	t.Helper()
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding GIF: %v", err)
+	}
+	return g
+}
+
+func TestSnapshotBadgesDoesNotTakeMu(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	mu.Lock()
+	defer mu.Unlock()
+	done := make(chan badgeSnapshot)
+	go func() { done <- snapshotBadges() }()
+	select {
+	case s := <-done:
+		if !slices.Equal(s.files, []string{"a.gif"}) {
+			t.Errorf("snapshot files = %v, want [a.gif]", s.files)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("snapshotBadges blocked while mu was held")
+	}
+}
+
+func BenchmarkBadgeHandler(b *testing.B) {
+	files := make(map[string][]byte)
+	for i := range 20 {
+		files["badge"+strconv.Itoa(i)+".gif"] = testGIF(b, 16, 16, 2)
+	}
+	useBadges(b, files)
+	handler := newBadgeHandler("")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		slot := 0
+		for pb.Next() {
+			slot++
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, "/badge.gif?slot="+strconv.Itoa(slot%20+1), nil))
+			if w.Code != http.StatusOK {
+				b.Fatalf("status = %d", w.Code)
+			}
+		}
+	})
+}
+
+// maxBadgeHandlerAllocs bounds the allocations of one /badge.gif request in
+// TestBadgeHandlerAllocs, recorder and request included. It was 99 when set,
+// with the badge list read from its snapshot rather than copied.
+const maxBadgeHandlerAllocs = 104
+
+func TestBadgeHandlerAllocs(t *testing.T) {
+	files := make(map[string][]byte)
+	for i := range 20 {
+		files["badge"+strconv.Itoa(i)+".gif"] = testGIF(t, 16, 16, 2)
+	}
+	useBadges(t, files)
+	handler := newBadgeHandler("")
+	slot := 0
+	allocs := testing.AllocsPerRun(200, func() {
+		slot++
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/badge.gif?slot="+strconv.Itoa(slot%20+1), nil))
+	})
+	if allocs > maxBadgeHandlerAllocs {
+		t.Errorf("a /badge.gif request allocates %.0f times, want at most %d", allocs, maxBadgeHandlerAllocs)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	two := map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 2, 2, 1)}
+	for _, tc := range []struct {
+		name      string
+		files     map[string][]byte
+		minBadges int
+		target    string
+		want      int
+		status    string
+	}{
+		{"no badges", nil, 1, "/healthz", http.StatusServiceUnavailable, "no badges"},
+		{"no badges ready", nil, 1, "/healthz?ready=1", http.StatusServiceUnavailable, "no badges"},
+		{"badges", two, 1, "/healthz", http.StatusOK, "ok"},
+		{"too few", two, 3, "/healthz", http.StatusOK, "ok"},
+		{"too few ready", two, 3, "/healthz?ready=1", http.StatusServiceUnavailable, "too few badges"},
+		{"enough ready", two, 2, "/healthz?ready=1", http.StatusOK, "ok"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useBadges(t, tc.files)
+			setForTest(t, &minBadges, tc.minBadges)
+			w := get(t, healthzHandler, tc.target)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d", w.Code, tc.want)
+			}
+			var health healthResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+				t.Fatal(err)
+			}
+			if health.Status != tc.status {
+				t.Errorf("status field = %q, want %q", health.Status, tc.status)
+			}
+		})
+	}
+}
+
+func TestValidateBadgeFilename(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		valid bool
+	}{
+		{"a.gif", true},
+		{"seasonal/winter.gif", true},
+		{"a..b.gif", true},
+		{"", false},
+		{"../../etc/passwd", false},
+		{"seasonal/../../a.gif", false},
+		{"/etc/passwd", false},
+		{`..\a.gif`, false},
+		{`seasonal\winter.gif`, false},
+	} {
+		if err := validateBadgeFilename(tc.name); (err == nil) != tc.valid {
+			t.Errorf("validateBadgeFilename(%q) = %v, want valid %v", tc.name, err, tc.valid)
+		}
+	}
+}
+
+func TestCheckBadgeFilenameRefusesTraversal(t *testing.T) {
+	w := httptest.NewRecorder()
+	if checkBadgeFilename(w, httptest.NewRequest(http.MethodGet, "/badge.gif", nil), "../../etc/passwd") {
+		t.Fatal("checkBadgeFilename accepted ../../etc/passwd")
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	for _, tc := range []struct {
+		filename string
+		data     []byte
+		want     string
+	}{
+		{"a.gif", testGIF(t, 2, 2, 1), "image/gif"},
+		{"a.png", testPNG(t, 2, 2), "image/png"},
+		{"a.gif", testPNG(t, 2, 2), "image/png"},
+		{"a.png", testGIF(t, 2, 2, 1), "image/gif"},
+		{"a.webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), "image/webp"},
+		// Content that doesn't sniff as an image keeps the extension's type.
+		{"a.png", []byte("not an image at all"), "image/png"},
+		{"a.gif", nil, "image/gif"},
+	} {
+		if got := detectContentType(tc.filename, tc.data); got != tc.want {
+			t.Errorf("detectContentType(%q, %.8q) = %q, want %q", tc.filename, tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestMislabeledBadgeContentType(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testPNG(t, 2, 2)})
+	w := get(t, newBadgeHandler(""), "/badge.gif?slot=1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png for a PNG named a.gif", ct)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	for _, accept := range []string{"", "text/html", "application/json", "application/json, */*"} {
+		req := httptest.NewRequest(http.MethodGet, "/badge.gif", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		writeError(w, req, "Badge not found", http.StatusNotFound)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Accept %q: status = %d, want %d", accept, w.Code, http.StatusNotFound)
+		}
+		var body errorResponse
+		err := json.Unmarshal(w.Body.Bytes(), &body)
+		if wantJSON := accept != "" && accept != "text/html"; wantJSON {
+			if err != nil || body != (errorResponse{Error: "Badge not found", Code: http.StatusNotFound}) {
+				t.Errorf("Accept %q: body = %q, want the JSON error", accept, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Accept %q: Content-Type = %q, want application/json", accept, ct)
+			}
+		} else if err == nil {
+			t.Errorf("Accept %q: body = %q, want plain text", accept, w.Body)
+		}
+	}
+}
+
+func TestBadgeHandlerErrorCodes(t *testing.T) {
+	setForTest(t, &servePlaceholder, false)
+	jsonGet := func(t *testing.T, target string) (int, errorResponse) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		newBadgeHandler("")(w, req)
+		var body errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: body %q is not a JSON error: %v", target, w.Body, err)
+		}
+		if body.Code != w.Code {
+			t.Errorf("%s: body code %d, status %d", target, body.Code, w.Code)
+		}
+		return w.Code, body
+	}
+
+	t.Run("no badges", func(t *testing.T) {
+		useBadges(t, nil)
+		if code, _ := jsonGet(t, "/badge.gif?slot=1"); code != http.StatusNotFound {
+			t.Errorf("status = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+	t.Run("invalid seed", func(t *testing.T) {
+		useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+		if code, _ := jsonGet(t, "/badge.gif?slot=1&seed=x"); code != http.StatusBadRequest {
+			t.Errorf("status = %d, want %d", code, http.StatusBadRequest)
+		}
+	})
+	t.Run("badge removed after discovery", func(t *testing.T) {
+		dir := useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+		if err := os.Remove(filepath.Join(dir, "a.gif")); err != nil {
+			t.Fatal(err)
+		}
+		if code, _ := jsonGet(t, "/badge.gif?slot=1"); code != http.StatusNotFound {
+			t.Errorf("status = %d, want %d", code, http.StatusNotFound)
+		}
+		waitForDiscovery()
+	})
+}
+
+func TestLoadWeights(t *testing.T) {
+	useBadges(t, map[string][]byte{
+		"weights.json": []byte(`{"a.gif": 0, "b.gif": 5, "c.gif": 1000000000}`),
+	})
+	want := map[string]int{"a.gif": 1, "b.gif": 5, "c.gif": maxBadgeWeight}
+	if got := loadWeights(); !maps.Equal(got, want) {
+		t.Errorf("loadWeights() = %v, want %v", got, want)
+	}
+
+	useBadges(t, map[string][]byte{"weights.json": []byte(`{"a.gif": "heavy"}`)})
+	if got := loadWeights(); got != nil {
+		t.Errorf("malformed weights: loadWeights() = %v, want nil", got)
+	}
+}
+
+func TestCheckBadgesDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.gif")
+	if err := os.WriteFile(file, testGIF(t, 2, 2, 1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		dir     string
+		wantErr bool
+	}{
+		{"directory", dir, false},
+		{"missing", filepath.Join(dir, "missing"), true},
+		{"file", file, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setForTest(t, &badgesDir, tc.dir)
+			err := checkBadgesDir()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("checkBadgesDir() = %v, want error %v", err, tc.wantErr)
+			}
+			if tc.name == "missing" && !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("checkBadgesDir() = %v, want it to wrap fs.ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestDiscoverySymlinks(t *testing.T) {
+	shared := t.TempDir()
+	if err := os.WriteFile(filepath.Join(shared, "shared.gif"), testGIF(t, 2, 2, 1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	for link, target := range map[string]string{
+		"linked.gif": filepath.Join(shared, "shared.gif"),
+		"broken.gif": filepath.Join(shared, "missing.gif"),
+		"folder.gif": shared,
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Skipf("symlinks unsupported: %v", err)
+		}
+	}
+	resetDiscovery()
+	discoverBadges()
+
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"a.gif", "linked.gif"}) {
+		t.Errorf("discovered %v, want [a.gif linked.gif]", files)
+	}
+	mu.Lock()
+	skipped := discoverySkipped
+	mu.Unlock()
+	for _, name := range []string{"broken.gif", "folder.gif"} {
+		if !slices.ContainsFunc(skipped, func(s skippedBadge) bool { return s.Name == name }) {
+			t.Errorf("%s is not listed as skipped: %v", name, skipped)
+		}
+	}
+	if w := get(t, newBadgeHandler(""), "/badge.gif?slot=1&seed=3"); w.Code != http.StatusOK {
+		t.Errorf("serving with a symlinked badge: status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"", "a_draft.gif", false},
+		{"*_draft.*", "a_draft.gif", true},
+		{"*_draft.*", "seasonal/winter_draft.png", true},
+		{"*_draft.*", "a.gif", false},
+		{"*_draft.*", "draft.gif", false},
+		{"wip/*", "wip/a.gif", true},
+		{"wip/*", "a.gif", false},
+		{"wip/*", "seasonal/wip.gif", false},
+	} {
+		setForTest(t, &excludePattern, tc.pattern)
+		if got := isExcluded(tc.name); got != tc.want {
+			t.Errorf("pattern %q: isExcluded(%q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResolveExcludePattern(t *testing.T) {
+	for value, want := range map[string]string{"": "", " *_draft.* ": "*_draft.*", "[broken": ""} {
+		t.Setenv("EXCLUDE_PATTERN", value)
+		if got := resolveExcludePattern(); got != want {
+			t.Errorf("EXCLUDE_PATTERN=%q gave %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestDiscoveryExcludesPattern(t *testing.T) {
+	setForTest(t, &excludePattern, "*_draft.*")
+	useBadges(t, map[string][]byte{
+		"a.gif":       testGIF(t, 2, 2, 1),
+		"b_draft.gif": testGIF(t, 2, 2, 1),
+	})
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"a.gif"}) {
+		t.Errorf("discovered %v, want [a.gif]", files)
+	}
+}
+
+// useBadgesAged is useBadges with each file's modtime set to age before
+// now, rediscovering once the modtimes are in place.
+func useBadgesAged(t testing.TB, ages map[string]time.Duration) {
+	t.Helper()
+	files := make(map[string][]byte, len(ages))
+	for name := range ages {
+		files[name] = testGIF(t, 2, 2, 1)
+	}
+	dir := useBadges(t, files)
+	now := time.Now()
+	for name, age := range ages {
+		if err := os.Chtimes(filepath.Join(dir, name), now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resetDiscovery()
+	discoverBadges()
+}
+
+func TestOrderBadges(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	modTimes := map[string]time.Time{
+		"b.gif": base.Add(2 * time.Hour),
+		"c.gif": base,
+		"a.gif": base.Add(time.Hour),
+		"d.gif": base.Add(2 * time.Hour),
+	}
+	for order, want := range map[string][]string{
+		"name":  {"a.gif", "b.gif", "c.gif", "d.gif"},
+		"mtime": {"b.gif", "d.gif", "a.gif", "c.gif"},
+		"none":  {"d.gif", "b.gif", "c.gif", "a.gif"},
+	} {
+		setForTest(t, &badgeOrder, order)
+		names := []string{"d.gif", "b.gif", "c.gif", "a.gif"}
+		orderBadges(names, modTimes)
+		if !slices.Equal(names, want) {
+			t.Errorf("ORDER=%s: got %v, want %v", order, names, want)
+		}
+	}
+}
+
+func TestResolveBadgeOrder(t *testing.T) {
+	for value, want := range map[string]string{"": "name", "name": "name", "mtime": "mtime", " none ": "none", "random": "name"} {
+		t.Setenv("ORDER", value)
+		if got := resolveBadgeOrder(); got != want {
+			t.Errorf("ORDER=%q gave %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestDiscoveryOrdersByModTime(t *testing.T) {
+	setForTest(t, &badgeOrder, "mtime")
+	useBadgesAged(t, map[string]time.Duration{"a.gif": 3 * time.Hour, "b.gif": time.Hour, "c.gif": 2 * time.Hour})
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"b.gif", "c.gif", "a.gif"}) {
+		t.Errorf("discovered %v, want newest first [b.gif c.gif a.gif]", files)
+	}
+}
+
+const testSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="88" height="31"><rect width="88" height="31" fill="#fff"/><text x="4" y="20">badge badge badge badge</text></svg>`
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"br, gzip;q=0.5":    true,
+		"deflate":           false,
+		"gzip;q=0":          false,
+		"gzip; q=0.000, br": false,
+		"*":                 true,
+		"identity, *;q=0.1": true,
+		"*;q=0, gzip":       true,
+		"gzip, *;q=0":       true,
+		"gzip;q=0, *":       false,
+		"*, gzip;q=0":       false,
+		"GZIP;Q=0.5":        true,
+		"gzip;q=0.":         false,
+		"gzip; q = 0.001":   true,
+		"gzip; q = 0":       false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/badge.gif", nil)
+		req.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(req); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestSVGGzipRoundTrip(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		t.Run("cache "+strconv.FormatBool(cached), func(t *testing.T) {
+			useBadges(t, map[string][]byte{"a.svg": []byte(testSVG)})
+			if cached {
+				badgeBytes = newBadgeCache(1 << 20)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/badge.gif?slot=1", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			newBadgeHandler("")(w, req)
+
+			if w.Header().Get("Content-Encoding") != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+			}
+			if !slices.Contains(w.Header().Values("Vary"), "Accept-Encoding") {
+				t.Errorf("Vary = %v, want Accept-Encoding", w.Header().Values("Vary"))
+			}
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != testSVG {
+				t.Errorf("decompressed body = %q, want the SVG", body)
+			}
+
+			plain := get(t, newBadgeHandler(""), "/badge.gif?slot=1")
+			gzipETag, plainETag := w.Header().Get("ETag"), plain.Header().Get("ETag")
+			if gzipETag == "" || gzipETag == plainETag {
+				t.Errorf("gzipped ETag %q, want one distinct from the uncompressed %q", gzipETag, plainETag)
+			}
+		})
+	}
+}
+
+func TestSVGSecurityHeaders(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.svg": []byte(testSVG), "b.gif": testGIF(t, 2, 2, 1)})
+	for target, handler := range map[string]http.HandlerFunc{
+		"/badge/a.svg":          fileBadgeRoute(),
+		"/badge.gif?format=svg": newBadgeHandler(""),
+	} {
+		w := get(t, handler, target)
+		if got := w.Header().Get("Content-Security-Policy"); got != svgContentSecurityPolicy {
+			t.Errorf("%s: Content-Security-Policy = %q, want %q", target, got, svgContentSecurityPolicy)
+		}
+		if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("%s: X-Content-Type-Options = %q, want nosniff", target, got)
+		}
+	}
+	if got := get(t, fileBadgeRoute(), "/badge/b.gif").Header().Get("Content-Security-Policy"); got != "" {
+		t.Errorf("GIF: Content-Security-Policy = %q, want none", got)
+	}
+}
+
+func TestRasterBadgesNotGzipped(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	req := httptest.NewRequest(http.MethodGet, "/badge.gif?slot=1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	newBadgeHandler("")(w, req)
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding = %q for a GIF, want none", enc)
+	}
+}
+
+func TestNewestBadges(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	modTimes := map[string]time.Time{
+		"a.gif": base,
+		"b.gif": base.Add(3 * time.Hour),
+		"c.gif": base.Add(time.Hour),
+		"d.gif": base.Add(3 * time.Hour),
+	}
+	names := []string{"a.gif", "b.gif", "c.gif", "d.gif"}
+	for _, tc := range []struct {
+		n           int
+		kept, older []string
+	}{
+		{0, names, nil},
+		{4, names, nil},
+		{9, names, nil},
+		{1, []string{"b.gif"}, []string{"d.gif", "c.gif", "a.gif"}},
+		{3, []string{"b.gif", "d.gif", "c.gif"}, []string{"a.gif"}},
+	} {
+		kept, older := newestBadges(names, modTimes, tc.n)
+		if !slices.Equal(kept, tc.kept) || !slices.Equal(older, tc.older) {
+			t.Errorf("newestBadges(n=%d) = %v, %v, want %v, %v", tc.n, kept, older, tc.kept, tc.older)
+		}
+	}
+}
+
+func TestDiscoveryKeepsNewestN(t *testing.T) {
+	setForTest(t, &newestN, 2)
+	useBadgesAged(t, map[string]time.Duration{"a.gif": time.Hour, "b.gif": 3 * time.Hour, "c.gif": 2 * time.Hour})
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"a.gif", "c.gif"}) {
+		t.Errorf("discovered %v, want the newest two, [a.gif c.gif]", files)
+	}
+	mu.Lock()
+	skipped := discoverySkipped
+	mu.Unlock()
+	if !slices.ContainsFunc(skipped, func(s skippedBadge) bool { return s.Name == "b.gif" }) {
+		t.Errorf("b.gif is not listed as skipped: %v", skipped)
+	}
+}
+
+func TestResolveNewestN(t *testing.T) {
+	for value, want := range map[string]int{"": 0, "3": 3, "0": 0, "-1": 0, "many": 0} {
+		t.Setenv("NEWEST_N", value)
+		if got := resolveNewestN(); got != want {
+			t.Errorf("NEWEST_N=%q gave %d, want %d", value, got, want)
+		}
+	}
+}
+
+func TestBadgeExt(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.gif":                ".gif",
+		"A.GIF":                ".gif",
+		"Badge.PNG.gif":        ".gif",
+		"badge.gif.PNG":        ".png",
+		"README":               "",
+		".gif":                 "",
+		"seasonal/.png":        "",
+		"seasonal.d/winter":    "",
+		"seasonal/Winter.JpEg": ".jpeg",
+	} {
+		if got := badgeExt(name); got != want {
+			t.Errorf("badgeExt(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExtensionCaseAgreesAcrossDiscoveryAndServing(t *testing.T) {
+	for name, want := range map[string]string{
+		"A.GIF":         "image/gif",
+		"Badge.GIF.png": "image/png",
+		"b.Png":         "image/png",
+		"c.SVG":         svgContentType,
+	} {
+		if !isSupportedBadge(name) {
+			t.Errorf("isSupportedBadge(%q) = false, want true", name)
+		}
+		if got := contentTypeFor(name); got != want {
+			t.Errorf("contentTypeFor(%q) = %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"README", "notes.txt", ".gif", "badge.gif.bak"} {
+		if isSupportedBadge(name) {
+			t.Errorf("isSupportedBadge(%q) = true, want false", name)
+		}
+	}
+}
+
+func TestDailyWindowBoundsAtLocalMidnight(t *testing.T) {
+	setForTest(t, &rotationMode, "daily")
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &rotationLocation, newYork)
+	for _, tc := range []struct {
+		at    time.Time
+		hours float64
+	}{
+		{time.Date(2025, 6, 1, 12, 0, 0, 0, newYork), 24},
+		// The spring-forward day is an hour short, the fall-back day an hour long.
+		{time.Date(2025, 3, 9, 12, 0, 0, 0, newYork), 23},
+		{time.Date(2025, 11, 2, 12, 0, 0, 0, newYork), 25},
+	} {
+		start, end := rotationWindowBounds(tc.at)
+		if h, m, s := start.In(newYork).Clock(); h != 0 || m != 0 || s != 0 {
+			t.Errorf("%s: window starts at %s, want local midnight", tc.at.Format(time.DateOnly), start.In(newYork))
+		}
+		if got := end.Sub(start).Hours(); got != tc.hours {
+			t.Errorf("%s: window is %v hours, want %v", tc.at.Format(time.DateOnly), got, tc.hours)
+		}
+		if windowSeed(end.Add(-time.Second)) != windowSeed(start) || windowSeed(end) != windowSeed(start)+1 {
+			t.Errorf("%s: the seed doesn't flip exactly at the window's end", tc.at.Format(time.DateOnly))
+		}
+	}
+}
+
+func TestFixedWindowSeed(t *testing.T) {
+	setForTest(t, &rotationMode, "window")
+	setForTest(t, &rotationWindowSeconds, int64(600))
+	start := time.Unix(1700000400, 0)
+	if windowSeed(start) != windowSeed(start.Add(599*time.Second)) {
+		t.Error("the seed changed within a window")
+	}
+	if windowSeed(start.Add(600*time.Second)) != windowSeed(start)+1 {
+		t.Error("the next window's seed isn't one more")
+	}
+}
+
+func TestPrefersPNG(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                 false,
+		"*/*":                              false,
+		"image/png":                        true,
+		"image/gif":                        false,
+		"image/png, image/gif":             false,
+		"image/png, image/gif;q=0.5":       true,
+		"image/gif;q=0.9, image/png":       true,
+		"image/png;q=0.4, image/gif;q=0.8": false,
+		"image/png, image/*;q=0.5":         true,
+		"image/*, image/png":               false,
+		"image/webp,image/apng,image/*,*/*;q=0.8": false,
+		"IMAGE/PNG": true,
+	} {
+		if got := prefersPNG(accept); got != want {
+			t.Errorf("prefersPNG(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestAcceptNegotiation(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.png": testPNG(t, 2, 2)})
+	for _, tc := range []struct {
+		target, accept, want string
+	}{
+		{"/badge.gif?slot=1", "image/png", "image/png"},
+		{"/badge.gif?slot=2", "image/png", "image/png"},
+		{"/badge.gif?slot=1&format=gif", "image/png", "image/gif"},
+		{"/badge.gif?slot=2&format=gif", "image/png", "image/gif"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		req.Header.Set("Accept", tc.accept)
+		w := httptest.NewRecorder()
+		newBadgeHandler("")(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != tc.want {
+			t.Errorf("%s with Accept %q: Content-Type = %q, want %q", tc.target, tc.accept, ct, tc.want)
+		}
+		if tc.target == "/badge.gif?slot=1" && !slices.Contains(w.Header().Values("Vary"), "Accept") {
+			t.Errorf("%s: Vary = %v, want Accept", tc.target, w.Header().Values("Vary"))
+		}
+	}
+
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	req := httptest.NewRequest(http.MethodGet, "/badge.gif?slot=1", nil)
+	req.Header.Set("Accept", "image/png")
+	w := httptest.NewRecorder()
+	newBadgeHandler("")(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/gif" {
+		t.Errorf("without PNG badges: status %d, Content-Type %q, want the GIF fallback", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestRootHandlerNegotiation(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	for accept, want := range map[string]string{
+		"":          "text/plain; charset=utf-8",
+		"*/*":       "text/plain; charset=utf-8",
+		"text/html": "text/html; charset=utf-8",
+		"text/html,application/xhtml+xml,*/*;q=0.8": "text/html; charset=utf-8",
+		"text/html;q=0, text/plain":                 "text/plain; charset=utf-8",
+		"text/plain, text/html;q=0.5":               "text/plain; charset=utf-8",
+		"text/*":                                    "text/plain; charset=utf-8",
+		"application/json":                          "application/json",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		rootHandler(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != want {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", accept, ct, want)
+		}
+	}
+}
+
+func TestRedirectToBadge(t *testing.T) {
+	dir := useBadges(t, map[string][]byte{
+		"a.gif":                 testGIF(t, 2, 2, 1),
+		"b.gif":                 testGIF(t, 2, 2, 1),
+		"seasonal/winter 1.gif": testGIF(t, 2, 2, 1),
+	})
+	setForTest(t, &redirectBase, "https://cdn.example.com/badges/")
+	// The redirect must not depend on the file, so a removed one still
+	// redirects.
+	for _, name := range []string{"a.gif", "b.gif"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := snapshotBadges()
+	for slot := 1; slot <= 3; slot++ {
+		name, err := s.pick(s.candidates("", ""), "", 77, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := get(t, newBadgeHandler(""), "/badge.gif?seed=77&slot="+strconv.Itoa(slot))
+		if w.Code != http.StatusFound {
+			t.Fatalf("slot %d: status = %d, want %d", slot, w.Code, http.StatusFound)
+		}
+		want := "https://cdn.example.com/badges/" + (&url.URL{Path: name}).EscapedPath()
+		if loc := w.Header().Get("Location"); loc != want {
+			t.Errorf("slot %d: Location = %q, want %q", slot, loc, want)
+		}
+		if w.Header().Get("Cache-Control") == "" {
+			t.Errorf("slot %d: no Cache-Control on the redirect", slot)
+		}
+	}
+}
+
+func TestResolveRedirectBase(t *testing.T) {
+	for value, want := range map[string]string{
+		"":                           "",
+		"https://cdn.example.com/b/": "https://cdn.example.com/b/",
+		" http://cdn.example.com/ ":  "http://cdn.example.com/",
+		"cdn.example.com/b/":         "",
+		"ftp://cdn.example.com/":     "",
+		"https:///b/":                "",
+	} {
+		t.Setenv("REDIRECT_BASE", value)
+		if got := resolveRedirectBase(); got != want {
+			t.Errorf("REDIRECT_BASE=%q gave %q, want %q", value, got, want)
+		}
+	}
+}
+
+// deniedFS is fsys with permission errors for the path denied and
+// everything under it, like a directory the server can't read.
+type deniedFS struct {
+	fs.FS
+	denied string
+}
+
+func (d deniedFS) Open(name string) (fs.File, error) {
+	if name == d.denied || strings.HasPrefix(name, d.denied+"/") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return d.FS.Open(name)
+}
+
+func TestDiscoverySkipsUnreadableEntries(t *testing.T) {
+	dir := useBadges(t, map[string][]byte{
+		"a.gif":          testGIF(t, 2, 2, 1),
+		"locked/b.gif":   testGIF(t, 2, 2, 1),
+		"seasonal/c.gif": testGIF(t, 2, 2, 1),
+	})
+	badgeFS = deniedFS{FS: os.DirFS(dir), denied: "locked"}
+	resetDiscovery()
+	discoverBadges()
+
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"a.gif", "seasonal/c.gif"}) {
+		t.Errorf("discovered %v, want the readable badges [a.gif seasonal/c.gif]", files)
+	}
+	mu.Lock()
+	skipped := discoverySkipped
+	mu.Unlock()
+	if !slices.ContainsFunc(skipped, func(s skippedBadge) bool { return s.Name == "locked" }) {
+		t.Errorf("the unreadable directory is not listed as skipped: %v", skipped)
+	}
+}
+
+func TestDiscoveryKeepsBadgesWhenRootUnreadable(t *testing.T) {
+	dir := useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	badgeFS = deniedFS{FS: os.DirFS(dir), denied: "."}
+	mu.Lock()
+	lastDiscoveryTime = time.Time{}
+	mu.Unlock()
+	discoverBadges()
+	if files := currentBadgeFiles(); !slices.Equal(files, []string{"a.gif"}) {
+		t.Errorf("badges after a failed discovery = %v, want the previous [a.gif]", files)
+	}
+}
+
+func TestBadgesJSONDimensions(t *testing.T) {
+	for _, record := range []bool{false, true} {
+		t.Run("record "+strconv.FormatBool(record), func(t *testing.T) {
+			setForTest(t, &recordDimensions, record)
+			useBadges(t, map[string][]byte{
+				"wide.gif": testGIF(t, 88, 31, 2),
+				"tall.png": testPNG(t, 20, 200),
+				"text.svg": []byte(testSVG),
+			})
+			w := get(t, badgesJSONHandler, "/badges.json")
+			var list badgeListResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+				t.Fatal(err)
+			}
+			if !record {
+				if list.Dimensions != nil {
+					t.Errorf("dimensions = %v without RECORD_DIMENSIONS, want none", list.Dimensions)
+				}
+				return
+			}
+			want := map[string]badgeSize{"wide.gif": {Width: 88, Height: 31}, "tall.png": {Width: 20, Height: 200}}
+			if !maps.Equal(list.Dimensions, want) {
+				t.Errorf("dimensions = %v, want %v, with none for the SVG", list.Dimensions, want)
+			}
+		})
+	}
+}
+
+func TestRotationTimingHeaders(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	setForTest(t, &rotationMode, "window")
+	setForTest(t, &rotationWindowSeconds, int64(600))
+
+	before := time.Now().Unix()
+	w := get(t, newBadgeHandler(""), "/badge.gif?slot=1")
+	if got := w.Header().Get("X-Rotation-Window-Seconds"); got != "600" {
+		t.Errorf("X-Rotation-Window-Seconds = %q, want 600", got)
+	}
+	next, err := strconv.ParseInt(w.Header().Get("X-Next-Rotation-Unix"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next%600 != 0 {
+		t.Errorf("X-Next-Rotation-Unix = %d, not on a window boundary", next)
+	}
+	if next <= before || next > before+600 {
+		t.Errorf("X-Next-Rotation-Unix = %d, want the end of the window containing %d", next, before)
+	}
+
+	for _, tc := range []struct {
+		mode, target string
+	}{
+		{"window", "/badge.gif?slot=1&seed=4"},
+		{"window", "/badge.gif?slot=1&key=user"},
+		{"fixed", "/badge.gif?slot=1"},
+	} {
+		setForTest(t, &rotationMode, tc.mode)
+		w := get(t, newBadgeHandler(""), tc.target)
+		if w.Header().Get("X-Next-Rotation-Unix") != "" || w.Header().Get("X-Rotation-Window-Seconds") != "" {
+			t.Errorf("%s mode %s: rotation headers set for a badge that doesn't rotate", tc.target, tc.mode)
+		}
+	}
+}
+
+func TestFileBadgeHandler(t *testing.T) {
+	gifData := testGIF(t, 2, 2, 1)
+	useBadges(t, map[string][]byte{"a.gif": gifData, "seasonal/winter.png": testPNG(t, 2, 2)})
+	if err := os.WriteFile(filepath.Join(filepath.Dir(badgesDir), "secret.gif"), gifData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	route := fileBadgeRoute()
+	for _, tc := range []struct {
+		target      string
+		code        int
+		contentType string
+	}{
+		{"/badge/a.gif", http.StatusOK, "image/gif"},
+		{"/badge/seasonal/winter.png", http.StatusOK, "image/png"},
+		{"/badge/missing.gif", http.StatusNotFound, ""},
+		{"/badge/seasonal", http.StatusNotFound, ""},
+		{"/badge/..%2Fsecret.gif", http.StatusNotFound, ""},
+		{"/badge/seasonal/..%2F..%2Fsecret.gif", http.StatusNotFound, ""},
+	} {
+		w := get(t, route, tc.target)
+		if w.Code != tc.code {
+			t.Errorf("%s: status = %d, want %d", tc.target, w.Code, tc.code)
+			continue
+		}
+		if tc.contentType != "" && w.Header().Get("Content-Type") != tc.contentType {
+			t.Errorf("%s: Content-Type = %q, want %q", tc.target, w.Header().Get("Content-Type"), tc.contentType)
+		}
+	}
+	if w := get(t, route, "/badge/a.gif"); !bytes.Equal(w.Body.Bytes(), gifData) {
+		t.Error("/badge/a.gif did not serve the file's bytes")
+	}
+}
+
+// fileBadgeRoute returns fileBadgeHandler routed as /badge/{filename...}, so
+// it sees the path value.
+func fileBadgeRoute() http.HandlerFunc {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/badge/{filename...}", fileBadgeHandler)
+	return mux.ServeHTTP
+}
+
+func TestRandomBadgeHandler(t *testing.T) {
+	kept := testGIF(t, 3, 3, 1)
+	dir := useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 2, 2, 1), "c.gif": kept})
+
+	setForTest(t, &minBadges, 4)
+	if w := get(t, randomBadgeHandler, "/random.gif"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("with too few badges: status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	minBadges = 0
+
+	for _, name := range []string{"a.gif", "b.gif"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		w := get(t, randomBadgeHandler, "/random.gif")
+		if w.Code != http.StatusOK {
+			t.Fatalf("with removed badges: status = %d, want %d", w.Code, http.StatusOK)
+		}
+		if !bytes.Equal(w.Body.Bytes(), kept) {
+			t.Fatal("served a badge other than the one left")
+		}
+	}
+	waitForDiscovery()
+}
+
+func TestDiscoverFlagLeavesCacheDirAlone(t *testing.T) {
+	dir := useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	out := runMain(t, []string{"BADGES_DIR=" + dir, "CACHE_DIR=" + cacheDir}, "-discover")
+	if !strings.HasPrefix(out, "Badges in ") {
+		t.Errorf("-discover printed %q, want the discovered badges", out)
+	}
+	if _, err := os.Stat(cacheDir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("-discover touched CACHE_DIR: stat error %v, want it missing", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// labeledCounter is a Prometheus-style counter partitioned by one label.
+type labeledCounter struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newLabeledCounter() *labeledCounter {
+	return &labeledCounter{values: make(map[string]uint64)}
+}
+
+func (c *labeledCounter) inc(label string) {
+	c.mu.Lock()
+	c.values[label]++
+	c.mu.Unlock()
+}
+
+// write emits the counter in the Prometheus text exposition format with
+// labels in sorted order.
+func (c *labeledCounter) write(b *strings.Builder, name, help, labelName string) {
+	c.mu.Lock()
+	labels := make([]string, 0, len(c.values))
+	for label := range c.values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, label := range labels {
+		fmt.Fprintf(b, "%s{%s=\"%s\"} %d\n", name, labelName, escapeLabelValue(label), c.values[label])
+	}
+	c.mu.Unlock()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+var (
+	badgeServesTotal = newLabeledCounter()
+	badgeErrorsTotal = newLabeledCounter()
+	badgesDiscovered atomic.Int64
+)
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	badgeServesTotal.write(&b, "badge_serves_total", "Badges served, by filename.", "filename")
+	badgeErrorsTotal.write(&b, "badge_errors_total", "Badge requests and discoveries that failed, by reason.", "reason")
+	fmt.Fprintf(&b, "# HELP badges_discovered Badges found by the last discovery.\n# TYPE badges_discovered gauge\nbadges_discovered %d\n", badgesDiscovered.Load())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// serveCounts tracks badges served, by filename, for /stats. Unlike
+// badgeServesTotal it can be reset, so it has its own lock.
+var serveCounts = struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	since  time.Time
+}{counts: make(map[string]int64), since: time.Now()}
+
+// recordServe counts a serve of filename in /metrics and /stats.
+func recordServe(filename string) {
+	badgeServesTotal.inc(filename)
+	serveCounts.mu.Lock()
+	serveCounts.counts[filename]++
+	serveCounts.mu.Unlock()
+}
+
+type badgeServeCount struct {
+	Filename string `json:"filename"`
+	Serves   int64  `json:"serves"`
+}
+
+type statsResponse struct {
+	TotalServes int64             `json:"totalServes"`
+	Uptime      string            `json:"uptime"`
+	Since       time.Time         `json:"since"`
+	Badges      []badgeServeCount `json:"badges"`
+}
+
+// statsHandler reports how often each badge has been served since startup
+// or the last reset, most served first. ?reset=1 clears the counts after
+// reporting them and requires admin credentials.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	reset := r.URL.Query().Get("reset") == "1"
+	if reset && !isAdmin(r) {
+		requireAdmin(w, r)
+		return
+	}
+
+	serveCounts.mu.Lock()
+	stats := statsResponse{
+		Uptime: time.Since(startTime).Round(time.Second).String(),
+		Since:  serveCounts.since,
+		Badges: make([]badgeServeCount, 0, len(serveCounts.counts)),
+	}
+	for filename, serves := range serveCounts.counts {
+		stats.Badges = append(stats.Badges, badgeServeCount{Filename: filename, Serves: serves})
+		stats.TotalServes += serves
+	}
+	if reset {
+		serveCounts.counts = make(map[string]int64)
+		serveCounts.since = time.Now()
+	}
+	serveCounts.mu.Unlock()
+	sort.Slice(stats.Badges, func(i, j int) bool {
+		if stats.Badges[i].Serves != stats.Badges[j].Serves {
+			return stats.Badges[i].Serves > stats.Badges[j].Serves
+		}
+		return stats.Badges[i].Filename < stats.Badges[j].Filename
+	})
+
+	body, err := json.Marshal(stats)
+	if err != nil {
+		requestLog(r).Error("could not encode stats response", "error", err)
+		writeError(w, r, "Error encoding stats response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+}
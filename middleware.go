@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCORSOrigin = "*"
+
+// corsOrigin is the Access-Control-Allow-Origin value sent with badge
+// responses, from CORS_ORIGIN.
+var corsOrigin = defaultCORSOrigin
+
+func resolveCORSOrigin() string {
+	if origin := strings.TrimSpace(os.Getenv("CORS_ORIGIN")); origin != "" {
+		return origin
+	}
+	return defaultCORSOrigin
+}
+
+// withCORS lets browsers read next's responses cross-origin and answers
+// OPTIONS preflight requests without calling next.
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", corsOrigin)
+		if corsOrigin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Link, X-Badge-Count, X-Max-Slots, X-Next-Rotation-Unix, X-Request-ID, X-Rotation-Window-Seconds")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requested)
+			}
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// withReadOnly rejects every method but GET and HEAD with 405. HEAD runs
+// next like GET; the standard library drops the body.
+func withReadOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminCredentials holds SHA-256 hashes of ADMIN_USER and ADMIN_PASS. It is
+// nil, leaving administrative routes open, when neither is set.
+var adminCredentials *[2][sha256.Size]byte
+
+func resolveAdminCredentials() *[2][sha256.Size]byte {
+	user, pass := os.Getenv("ADMIN_USER"), os.Getenv("ADMIN_PASS")
+	if user == "" && pass == "" {
+		return nil
+	}
+	if user == "" || pass == "" {
+		slog.Warn("only one of ADMIN_USER and ADMIN_PASS is set, the other is required to be empty")
+	}
+	return &[2][sha256.Size]byte{sha256.Sum256([]byte(user)), sha256.Sum256([]byte(pass))}
+}
+
+// withAdminAuth requires HTTP Basic Auth matching adminCredentials before
+// calling next. Credentials are compared as hashes in constant time, so
+// neither their contents nor their lengths leak through timing.
+func withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			requireAdmin(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isAdmin reports whether r carries credentials matching adminCredentials,
+// or whether none are configured.
+func isAdmin(r *http.Request) bool {
+	if adminCredentials == nil {
+		return true
+	}
+	user, pass, _ := r.BasicAuth()
+	userHash, passHash := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(pass))
+	userOK := subtle.ConstantTimeCompare(userHash[:], adminCredentials[0][:])
+	passOK := subtle.ConstantTimeCompare(passHash[:], adminCredentials[1][:])
+	return userOK&passOK == 1
+}
+
+// requireAdmin answers 401 with a Basic Auth challenge.
+func requireAdmin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="badge rotator admin", charset="UTF-8"`)
+	writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+}
+
+type requestLogKey struct{}
+
+// maxRequestIDLength bounds client-supplied X-Request-ID values.
+const maxRequestIDLength = 128
+
+// withRequestID tags each request with an ID, taken from its X-Request-ID
+// header when that is a reasonable value and generated otherwise. The ID is
+// echoed in the response and added to every line logged via requestLog.
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = fmt.Sprintf("%016x", rand.Uint64())
+		}
+		w.Header().Set("X-Request-ID", id)
+		logger := slog.With("requestID", id)
+		next(w, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, logger)))
+	}
+}
+
+// validRequestID accepts IDs of printable ASCII without spaces, so a client
+// can't inject log or header content.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLog returns the logger for r, carrying its request ID.
+func requestLog(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(requestLogKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter is a per-client token bucket limiter keyed by IP address.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// rateLimiterIdleTTL is how long a client's bucket is kept after its last
+// request. A bucket idle this long has refilled completely anyway.
+const rateLimiterIdleTTL = 10 * time.Minute
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// allow takes a token for key, returning how long to wait before retrying
+// when none is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimiterIdleTTL {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastSeen) > rateLimiterIdleTTL {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.lastSeen).Seconds()*l.rate)
+	b.lastSeen = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// badgeRateLimiter limits badge requests per client. It is nil, disabling
+// limiting, unless RATE_LIMIT_RPS is set.
+var badgeRateLimiter *rateLimiter
+
+const defaultRateLimitBurst = 20
+
+// resolveRateLimiter builds the limiter from RATE_LIMIT_RPS and
+// RATE_LIMIT_BURST, returning nil when RATE_LIMIT_RPS is unset or invalid.
+func resolveRateLimiter() *rateLimiter {
+	value := strings.TrimSpace(os.Getenv("RATE_LIMIT_RPS"))
+	if value == "" {
+		return nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate <= 0 {
+		slog.Warn("invalid RATE_LIMIT_RPS, rate limiting disabled", "value", value)
+		return nil
+	}
+	burst := defaultRateLimitBurst
+	if value := strings.TrimSpace(os.Getenv("RATE_LIMIT_BURST")); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			slog.Warn("invalid RATE_LIMIT_BURST, using default", "value", value, "default", defaultRateLimitBurst)
+		} else {
+			burst = parsed
+		}
+	}
+	return newRateLimiter(rate, burst)
+}
+
+// clientIP returns the address requests are rate limited by. Behind Vercel's
+// proxy (VERCEL=1) that is the first X-Forwarded-For entry; otherwise it is
+// the connection's remote address.
+func clientIP(r *http.Request) string {
+	if os.Getenv("VERCEL") == "1" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// withRateLimit rejects requests with 429 once the client's bucket in
+// badgeRateLimiter is empty.
+func withRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if badgeRateLimiter == nil {
+			next(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if ok, wait := badgeRateLimiter.allow(ip, time.Now()); !ok {
+			requestLog(r).Warn("rate limit exceeded", "ip", ip)
+			badgeErrorsTotal.inc("rate_limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// serveTimeout, from SERVE_TIMEOUT, bounds how long a badge request may take,
+// including the stat and read of its file. Zero, the default, leaves requests
+// unbounded.
+var serveTimeout time.Duration
+
+func resolveServeTimeout() time.Duration {
+	value := strings.TrimSpace(os.Getenv("SERVE_TIMEOUT"))
+	if value == "" {
+		return 0
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		slog.Warn("invalid SERVE_TIMEOUT, serving without a timeout", "value", value)
+		return 0
+	}
+	return timeout
+}
+
+// withServeTimeout answers with 503, through writeError, once serveTimeout
+// elapses, or gives up as soon as the client goes away, freeing the
+// connection even while next is stuck on hung storage. next's request
+// context is cancelled at the same point, so waits that watch it, like
+// DEBUG_DELAY, also stop. next writes to a buffer that is sent only if it
+// finishes in time; anything it writes later is discarded.
+func withServeTimeout(next http.HandlerFunc) http.HandlerFunc {
+	if serveTimeout == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), serveTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{header: w.Header().Clone()}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next(tw, r)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			clear(w.Header())
+			maps.Copy(w.Header(), tw.header)
+			if tw.code != 0 {
+				w.WriteHeader(tw.code)
+			}
+			w.Write(tw.body.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				requestLog(r).Error("badge request timed out", "path", r.URL.Path, "timeout", serveTimeout.String())
+				badgeErrorsTotal.inc("timeout")
+				writeError(w, r, "Timed out serving badge", http.StatusServiceUnavailable)
+			}
+		}
+	}
+}
+
+// timeoutWriter buffers the response of a handler run by withServeTimeout,
+// refusing writes once the request has timed out.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.code == 0 && !tw.timedOut {
+		tw.code = code
+	}
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	return tw.body.Write(p)
+}
+
+const defaultSlowRequestThreshold = 500 * time.Millisecond
+
+// slowRequestThreshold, from SLOW_REQUEST_THRESHOLD, is how long a badge
+// request may take before withSlowRequestLog warns about it. Zero turns the
+// warnings off.
+var slowRequestThreshold = defaultSlowRequestThreshold
+
+func resolveSlowRequestThreshold() time.Duration {
+	value := strings.TrimSpace(os.Getenv("SLOW_REQUEST_THRESHOLD"))
+	if value == "" {
+		return defaultSlowRequestThreshold
+	}
+	threshold, err := time.ParseDuration(value)
+	if err != nil || threshold < 0 {
+		slog.Warn("invalid SLOW_REQUEST_THRESHOLD, using default", "value", value, "default", defaultSlowRequestThreshold.String())
+		return defaultSlowRequestThreshold
+	}
+	return threshold
+}
+
+type servedBadgeKey struct{}
+
+// noteServedBadge records name as the badge r is answered with, for
+// withSlowRequestLog to report. A handler still running after
+// withServeTimeout gave up on it can call this as the log is written, hence
+// the atomic.
+func noteServedBadge(r *http.Request, name string) {
+	if served, ok := r.Context().Value(servedBadgeKey{}).(*atomic.Pointer[string]); ok {
+		served.Store(&name)
+	}
+}
+
+// countingWriter counts the body bytes written through it.
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// withSlowRequestLog times next and warns when it takes longer than
+// slowRequestThreshold, with the badge noteServedBadge recorded and the
+// bytes written, so large or slow assets stand out. Other requests are
+// logged at debug.
+func withSlowRequestLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		served := new(atomic.Pointer[string])
+		counter := &countingWriter{ResponseWriter: w}
+		start := time.Now()
+		next(counter, r.WithContext(context.WithValue(r.Context(), servedBadgeKey{}, served)))
+		elapsed := time.Since(start)
+
+		var filename string
+		if name := served.Load(); name != nil {
+			filename = *name
+		}
+		attrs := []any{"path", r.URL.Path, "filename", filename, "bytes", counter.written, "duration", elapsed.String()}
+		if slowRequestThreshold > 0 && elapsed > slowRequestThreshold {
+			requestLog(r).Warn("slow badge request", append(attrs, "threshold", slowRequestThreshold.String())...)
+			return
+		}
+		requestLog(r).Debug("badge request finished", attrs...)
+	}
+}
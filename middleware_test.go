@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServeTimeoutWritesError(t *testing.T) {
+	setForTest(t, &serveTimeout, 20*time.Millisecond)
+	late := make(chan error, 1)
+	handler := withRequestID(withServeTimeout(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/gif")
+		_, err := w.Write([]byte("GIF89a"))
+		late <- err
+	}))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/badge.gif", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Request-ID", "test-id")
+	handler(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if id := w.Header().Get("X-Request-ID"); id != "test-id" {
+		t.Errorf("X-Request-ID = %q, want test-id", id)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not a JSON error: %v", w.Body, err)
+	}
+	if body.Code != http.StatusServiceUnavailable {
+		t.Errorf("error code = %d, want %d", body.Code, http.StatusServiceUnavailable)
+	}
+	if err := <-late; !errors.Is(err, http.ErrHandlerTimeout) {
+		t.Errorf("late write returned %v, want ErrHandlerTimeout", err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want the late handler's header discarded", ct)
+	}
+}
+
+func TestServeTimeoutPassesResponseThrough(t *testing.T) {
+	setForTest(t, &serveTimeout, time.Second)
+	handler := withServeTimeout(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Del("X-Outer")
+		w.Header().Set("Content-Type", "image/gif")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("GIF89a"))
+	})
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Outer", "set")
+	handler(w, httptest.NewRequest(http.MethodGet, "/badge.gif", nil))
+
+	if w.Code != http.StatusTeapot {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusTeapot)
+	}
+	if w.Body.String() != "GIF89a" {
+		t.Errorf("body = %q, want GIF89a", w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/gif" {
+		t.Errorf("Content-Type = %q, want image/gif", ct)
+	}
+	if w.Header().Get("X-Outer") != "" {
+		t.Error("a header next deleted was still sent")
+	}
+}
+
+func TestServeTimeoutRepanics(t *testing.T) {
+	setForTest(t, &serveTimeout, time.Second)
+	handler := withServeTimeout(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("recovered %v, want the handler's panic", p)
+		}
+	}()
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/badge.gif", nil))
+}
+
+func TestReadOnlyMethods(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1)})
+	server := httptest.NewServer(withReadOnly(newBadgeHandler("")))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		method string
+		want   int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodHead, http.StatusOK},
+		{http.MethodPost, http.StatusMethodNotAllowed},
+		{http.MethodDelete, http.StatusMethodNotAllowed},
+	} {
+		req, err := http.NewRequest(tc.method, server.URL+"/badge.gif?slot=1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.method, resp.StatusCode, tc.want)
+		}
+		switch tc.method {
+		case http.MethodGet:
+			if len(body) == 0 {
+				t.Error("GET: empty body")
+			}
+		case http.MethodHead:
+			if len(body) != 0 {
+				t.Errorf("HEAD: body of %d bytes, want none", len(body))
+			}
+			if resp.Header.Get("X-Badge-Count") != "1" || resp.Header.Get("Content-Type") != "image/gif" {
+				t.Errorf("HEAD: headers %v, want those GET sends", resp.Header)
+			}
+		default:
+			if allow := resp.Header.Get("Allow"); allow != "GET, HEAD" {
+				t.Errorf("%s: Allow = %q, want %q", tc.method, allow, "GET, HEAD")
+			}
+		}
+	}
+}
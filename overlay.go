@@ -0,0 +1,108 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+var overlayPage = template.Must(template.New("overlay").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Badge Rotator overlay</title>
+<style>
+html, body { margin: 0; background: {{.Background}}; }
+img { display: block; }
+</style>
+</head>
+<body>
+<img id="badge" alt="">
+<script>
+(function () {
+  var img = document.getElementById("badge");
+  var src = {{.Src}};
+  var shown = null;
+  var previous = 0;
+  // Each badge is fetched in full before it replaces the current one, so
+  // the swap never shows a half-loaded image, and the next fetch is timed
+  // from the response's rotation headers against the server's clock.
+  function load() {
+    fetch(src, { cache: "no-store" }).then(function (response) {
+      if (!response.ok) {
+        throw new Error("badge request failed: " + response.status);
+      }
+      var next = Number(response.headers.get("X-Next-Rotation-Unix"));
+      var serverNow = Date.parse(response.headers.get("Date")) || Date.now();
+      return response.blob().then(function (blob) {
+        var url = URL.createObjectURL(blob);
+        img.onload = function () {
+          if (shown) {
+            URL.revokeObjectURL(shown);
+          }
+          shown = url;
+        };
+        img.src = url;
+        if (next > 0) {
+          // A fetch that lands just before the flip sees the same window
+          // again; back off rather than refetching in a loop.
+          var delay = next === previous ? 1000 : Math.max(0, next * 1000 - serverNow);
+          previous = next;
+          setTimeout(load, delay);
+        }
+      });
+    }).catch(function () {
+      setTimeout(load, 5000);
+    });
+  }
+  load();
+})();
+</script>
+</body>
+</html>
+`))
+
+// overlayBackground accepts the bg values the overlay page styles itself
+// with: a hex colour such as #00ff00, without the #, or a CSS colour name.
+var overlayBackground = regexp.MustCompile(`^(#?[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+type overlayData struct {
+	Src        string
+	Background string
+}
+
+// overlayHandler serves /overlay, a page for livestream overlays showing the
+// badge for the slot query parameter. It fetches /badge.gif itself and
+// fetches again when X-Next-Rotation-Unix says the window flips, swapping
+// the new badge in once it has loaded. bg sets the page background, which
+// defaults to transparent.
+func overlayHandler(w http.ResponseWriter, r *http.Request) {
+	background := "transparent"
+	if bg := r.URL.Query().Get("bg"); bg != "" {
+		if !overlayBackground.MatchString(bg) {
+			writeError(w, r, "bg must be a hex colour or a CSS colour name", http.StatusBadRequest)
+			return
+		}
+		background = bg
+		if _, err := strconv.ParseUint(bg, 16, 32); err == nil && (len(bg) == 3 || len(bg) == 6 || len(bg) == 8) {
+			background = "#" + bg
+		}
+	}
+	if err := checkStrictSlot(r.URL.Query().Get("slot"), len(snapshotBadges().candidates("", ""))); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slot := parseSlot(r.URL.Query().Get("slot"))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setNoCacheHeaders(w)
+	data := overlayData{
+		Src:        "/badge.gif?" + url.Values{"slot": {strconv.Itoa(slot)}}.Encode(),
+		Background: background,
+	}
+	if err := overlayPage.Execute(w, data); err != nil {
+		requestLog(r).Error("could not render overlay", "error", err)
+	}
+}
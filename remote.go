@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// remoteFetchTimeout bounds each request for the remote index or a badge.
+const remoteFetchTimeout = 10 * time.Second
+
+var remoteClient = &http.Client{Timeout: remoteFetchTimeout}
+
+// badgesURL, from BADGES_URL, is a JSON index of remote badge URLs that
+// replaces scanning badgesDir when set.
+var badgesURL string
+
+// remoteBadge is a badge listed by the remote index.
+type remoteBadge struct {
+	url      string
+	listedAt time.Time
+}
+
+// remoteBadges maps remote badge names to where they are fetched from. It is
+// nil when badges come from badgesDir, and is replaced, never modified, by
+// discoverBadges.
+var remoteBadges map[string]remoteBadge
+
+func isRemoteBadgePath(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// fetchRemoteIndex reads the badge index at indexURL, a JSON array of badge
+// URLs that may be relative to the index itself. A badge under the index's
+// directory is named by its path from there, like "seasonal/winter.gif", so
+// groups work as they do locally; anything else is named by its last path
+// element.
+func fetchRemoteIndex(indexURL string) (badgeListing, error) {
+	base, err := url.Parse(indexURL)
+	if err != nil {
+		return badgeListing{}, fmt.Errorf("invalid BADGES_URL: %w", err)
+	}
+	data, err := fetchRemote(indexURL)
+	if err != nil {
+		return badgeListing{}, err
+	}
+	var entries []string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return badgeListing{}, fmt.Errorf("malformed badge index: %w", err)
+	}
+
+	listedAt := time.Now()
+	listing := badgeListing{modTimes: make(map[string]time.Time), remote: make(map[string]remoteBadge)}
+	baseDir := strings.TrimSuffix(path.Dir(base.Path), "/") + "/"
+	for _, entry := range entries {
+		ref, err := url.Parse(entry)
+		if err != nil {
+			listing.skipped = append(listing.skipped, skippedBadge{Name: entry, Reason: "invalid URL"})
+			continue
+		}
+		resolved := base.ResolveReference(ref)
+		name := path.Base(resolved.Path)
+		if resolved.Host == base.Host && strings.HasPrefix(resolved.Path, baseDir) {
+			name = strings.TrimPrefix(resolved.Path, baseDir)
+		}
+		switch {
+		case !isSupportedBadge(name):
+			listing.skipped = append(listing.skipped, skippedBadge{Name: entry, Reason: "unsupported extension"})
+		case isExcluded(name):
+			listing.skipped = append(listing.skipped, skippedBadge{Name: entry, Reason: excludedReason})
+		case validateBadgeFilename(name) != nil:
+			listing.skipped = append(listing.skipped, skippedBadge{Name: entry, Reason: "invalid name"})
+		case listing.remote[name].url != "":
+			listing.skipped = append(listing.skipped, skippedBadge{Name: entry, Reason: "duplicate name " + name})
+		default:
+			// Remote badges have no modtime, so cached copies are refreshed
+			// whenever the index is.
+			listing.names = append(listing.names, name)
+			listing.remote[name] = remoteBadge{url: resolved.String(), listedAt: listedAt}
+			listing.modTimes[name] = listedAt
+		}
+	}
+	return listing, nil
+}
+
+// fetchRemote GETs rawURL and returns the response body, failing once it
+// grows past maxBadgeBytes.
+func fetchRemote(rawURL string) ([]byte, error) {
+	resp, err := remoteClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", rawURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBadgeBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBadgeBytes {
+		return nil, fmt.Errorf("fetching %s: response exceeds MAX_BADGE_BYTES", rawURL)
+	}
+	return data, nil
+}
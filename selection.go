@@ -0,0 +1,204 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+)
+
+// SelectionStrategy selects the badge for slot from files for one seed.
+// Implementations are pure functions of their arguments and fields, so the
+// same files, seed and slot always select the same badge.
+type SelectionStrategy interface {
+	Select(files []string, seed int64, slot int) (string, error)
+}
+
+// rotationModes is the registry of ROTATION_MODE values. Each builds the
+// strategy badgeSnapshot.pick uses, from the snapshot's sequence and
+// weights; how often the seed changes is up to windowSeed.
+var rotationModes = map[string]func(badgeSnapshot) SelectionStrategy{
+	"window": rotatingStrategy,
+	"daily":  rotatingStrategy,
+	"fixed": func(s badgeSnapshot) SelectionStrategy {
+		return filtered(s, fixedStrategy{})
+	},
+	// The seed is the client's session position, which advances by one
+	// per request, so stepping through the sequence serves the next badge.
+	"session": func(s badgeSnapshot) SelectionStrategy {
+		return filtered(s, sequenceStrategy{})
+	},
+}
+
+// newStrategy is the rotationModes entry for rotationMode, set at startup.
+var newStrategy = rotatingStrategy
+
+// rotatingStrategy follows the loaded sequence when there is one and
+// otherwise shuffles the badges, repeated by their weights.
+func rotatingStrategy(s badgeSnapshot) SelectionStrategy {
+	if s.sequence != nil {
+		return filtered(s, sequenceStrategy{})
+	}
+	return weightedStrategy{weights: s.weights, next: filtered(s, shuffleStrategy{})}
+}
+
+// filtered wraps next in the snapshot's format filter, when it has one.
+// Builders apply it to the strategy that orders the badges, inside any
+// weighting, so the filter sees every weighted position.
+func filtered(s badgeSnapshot, next SelectionStrategy) SelectionStrategy {
+	if s.keep == nil {
+		return next
+	}
+	return filteredStrategy{keep: s.keep, next: next}
+}
+
+// shuffleStrategy shuffles files with seed and returns the badge at the
+// slot's position.
+//
+// Every slot shares one shuffle per seed, so slots 1..len(files) map to
+// distinct positions and, when files has no duplicates, distinct badges.
+// Slots beyond that wrap around: slot len(files)+1 repeats slot 1. Weighted
+// lists repeat badges on purpose and so may repeat them across slots.
+type shuffleStrategy struct{}
+
+func (shuffleStrategy) Select(files []string, seed int64, slot int) (string, error) {
+	if len(files) == 0 {
+		return "", errNoBadges
+	}
+	if slot < 1 {
+		return "", errInvalidSlot
+	}
+
+	tempIndices := shuffledIndices(len(files), seed)
+	effectiveSlotIndex := (slot - 1) % len(tempIndices)
+	return files[tempIndices[effectiveSlotIndex]], nil
+}
+
+// order returns files in the order slots 1..len(files) select them.
+func (shuffleStrategy) order(files []string, seed int64) []string {
+	ordered := make([]string, len(files))
+	for i, index := range shuffledIndices(len(files), seed) {
+		ordered[i] = files[index]
+	}
+	return ordered
+}
+
+func shuffledIndices(n int, seed int64) []int {
+	tempIndices := make([]int, n)
+	for i := range tempIndices {
+		tempIndices[i] = i
+	}
+	shuffleRand := rand.New(rand.NewSource(seed))
+	shuffleRand.Shuffle(len(tempIndices), func(i, j int) {
+		tempIndices[i], tempIndices[j] = tempIndices[j], tempIndices[i]
+	})
+	return tempIndices
+}
+
+// weightedStrategy repeats files by weights, as applyWeights does, before
+// running next over them.
+type weightedStrategy struct {
+	weights map[string]int
+	next    SelectionStrategy
+}
+
+func (w weightedStrategy) Select(files []string, seed int64, slot int) (string, error) {
+	return w.next.Select(applyWeights(files, w.weights), seed, slot)
+}
+
+// orderer is implemented by strategies that can list the order they select
+// files in more cheaply than one pick per slot.
+type orderer interface {
+	order(files []string, seed int64) []string
+}
+
+// filteredStrategy orders files with next, as slots 1..len(files) would
+// select them, and maps slots onto the badges keep accepts in that order.
+// Filtering after ordering keeps a filtered slot consistent with the
+// unfiltered ones for the same seed, where filtering first would reorder
+// everything.
+type filteredStrategy struct {
+	keep func(string) bool
+	next SelectionStrategy
+}
+
+func (f filteredStrategy) Select(files []string, seed int64, slot int) (string, error) {
+	if slot < 1 {
+		return "", errInvalidSlot
+	}
+	var ordered []string
+	if o, ok := f.next.(orderer); ok {
+		ordered = o.order(files, seed)
+	} else {
+		for i := range files {
+			name, err := f.next.Select(files, seed, i+1)
+			if err != nil {
+				return "", err
+			}
+			ordered = append(ordered, name)
+		}
+	}
+	ordered = slices.DeleteFunc(ordered, func(name string) bool { return !f.keep(name) })
+	if len(ordered) == 0 {
+		return "", errNoBadges
+	}
+	return ordered[(slot-1)%len(ordered)], nil
+}
+
+// sequenceStrategy returns the badge at the slot's position in files, taken
+// as an author-defined order rather than shuffled. The whole sequence
+// advances one position per seed, so each rotation window shifts every slot
+// along.
+type sequenceStrategy struct{}
+
+func (sequenceStrategy) Select(files []string, seed int64, slot int) (string, error) {
+	if len(files) == 0 {
+		return "", errNoBadges
+	}
+	if slot < 1 {
+		return "", errInvalidSlot
+	}
+	n := int64(len(files))
+	index := ((seed+int64(slot-1))%n + n) % n
+	return files[index], nil
+}
+
+// fixedStrategy maps slot n to the nth of files, wrapping around, whatever
+// the seed. Files are in discovered order, set by ORDER, or sequence order
+// when there is one.
+type fixedStrategy struct{}
+
+func (fixedStrategy) Select(files []string, seed int64, slot int) (string, error) {
+	if len(files) == 0 {
+		return "", errNoBadges
+	}
+	if slot < 1 {
+		return "", errInvalidSlot
+	}
+	return files[(slot-1)%len(files)], nil
+}
+
+// featuredStrategy pins featured to slot 1 and fills the remaining slots by
+// running next over the other badges, so slot 2 takes the first position.
+// Without a featured badge in files it is next.
+type featuredStrategy struct {
+	featured string
+	next     SelectionStrategy
+}
+
+func (f featuredStrategy) Select(files []string, seed int64, slot int) (string, error) {
+	if f.featured == "" || !slices.Contains(files, f.featured) {
+		return f.next.Select(files, seed, slot)
+	}
+	if slot == 1 {
+		return f.featured, nil
+	}
+	rest := make([]string, 0, len(files))
+	for _, name := range files {
+		if name != f.featured {
+			rest = append(rest, name)
+		}
+	}
+	if len(rest) == 0 {
+		return f.featured, nil
+	}
+	return f.next.Select(rest, seed, slot-1)
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShufflePick(t *testing.T) {
+	files := []string{"a.gif", "b.gif", "c.gif"}
+	tests := []struct {
+		name    string
+		files   []string
+		slot    int
+		wantErr error
+	}{
+		{name: "empty list", files: nil, slot: 1, wantErr: errNoBadges},
+		{name: "slot zero", files: files, slot: 0, wantErr: errInvalidSlot},
+		{name: "negative slot", files: files, slot: -3, wantErr: errInvalidSlot},
+		{name: "first slot", files: files, slot: 1},
+		{name: "last slot", files: files, slot: 3},
+		{name: "slot beyond len", files: files, slot: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := shuffleStrategy{}.Select(tt.files, 42, tt.slot)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("pick error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !slices.Contains(tt.files, got) {
+				t.Fatalf("pick = %q, not one of %v", got, tt.files)
+			}
+		})
+	}
+}
+
+func TestShufflePickWrapsBeyondLen(t *testing.T) {
+	files := []string{"a.gif", "b.gif", "c.gif"}
+	for slot := 1; slot <= len(files); slot++ {
+		first, _ := shuffleStrategy{}.Select(files, 7, slot)
+		wrapped, _ := shuffleStrategy{}.Select(files, 7, slot+len(files))
+		if first != wrapped {
+			t.Errorf("slot %d = %q but slot %d = %q, want the same badge", slot, first, slot+len(files), wrapped)
+		}
+	}
+}
+
+func TestShufflePickDeterministic(t *testing.T) {
+	files := []string{"a.gif", "b.gif", "c.gif", "d.gif", "e.gif"}
+	for _, seed := range []int64{0, 1, 42, -9, 1 << 40} {
+		for slot := 1; slot <= len(files)+2; slot++ {
+			want, err := shuffleStrategy{}.Select(files, seed, slot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 5 {
+				if got, _ := (shuffleStrategy{}).Select(files, seed, slot); got != want {
+					t.Fatalf("seed %d slot %d gave %q then %q", seed, slot, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestBadgeHandlerSelection(t *testing.T) {
+	useBadges(t, map[string][]byte{
+		"a.gif": testGIF(t, 2, 2, 1),
+		"b.gif": testGIF(t, 3, 3, 1),
+		"c.gif": testGIF(t, 4, 4, 1),
+	})
+	handler := newBadgeHandler("")
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{name: "slot 1", target: "/badge.gif?slot=1&seed=5", status: http.StatusOK},
+		{name: "missing slot", target: "/badge.gif?seed=5", status: http.StatusOK},
+		{name: "slot below 1", target: "/badge.gif?slot=0&seed=5", status: http.StatusOK},
+		{name: "slot beyond len", target: "/badge.gif?slot=9&seed=5", status: http.StatusOK},
+		{name: "malformed seed", target: "/badge.gif?slot=1&seed=x", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(t, handler, tt.target)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	first := get(t, handler, "/badge.gif?slot=2&seed=5").Body.String()
+	for range 5 {
+		if got := get(t, handler, "/badge.gif?slot=2&seed=5").Body.String(); got != first {
+			t.Fatal("same slot and seed served different badges")
+		}
+	}
+}
+
+func TestBadgeHandlerNoBadges(t *testing.T) {
+	useBadges(t, nil)
+	setForTest(t, &servePlaceholder, false)
+	if w := get(t, newBadgeHandler(""), "/badge.gif?slot=1"); w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", w.Code)
+	}
+}
+
+func TestSaltedSequenceSteps(t *testing.T) {
+	sequence := []string{"easy.gif", "hard.gif", "evangelion.gif", "normal.gif"}
+	s := badgeSnapshot{files: sequence, sequence: sequence}
+	for _, salt := range []int64{0, 1, 0x5bd1e995, -7 << 50} {
+		setForTest(t, &instanceSalt, salt)
+		first, err := s.pick(s.candidates("", ""), "", 100, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := slices.Index(sequence, first)
+		for step := int64(1); step <= 5; step++ {
+			got, _ := s.pick(s.candidates("", ""), "", 100+step, 1)
+			want := sequence[(start+int(step))%len(sequence)]
+			if got != want {
+				t.Fatalf("salt %d: seed %d gave %q, want %q one step after seed %d", salt, 100+step, got, want, 100+step-1)
+			}
+		}
+	}
+}
+
+func TestSaltChangesShuffle(t *testing.T) {
+	files := []string{"a.gif", "b.gif", "c.gif", "d.gif", "e.gif", "f.gif"}
+	s := badgeSnapshot{files: files}
+	order := func() []string {
+		var got []string
+		for slot := 1; slot <= len(files); slot++ {
+			name, err := s.pick(files, "", 100, slot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, name)
+		}
+		return got
+	}
+	setForTest(t, &instanceSalt, 0)
+	unsalted := order()
+	t.Setenv("INSTANCE_SALT", "replica-b")
+	instanceSalt = resolveInstanceSalt()
+	if slices.Equal(order(), unsalted) {
+		t.Fatal("INSTANCE_SALT left the shuffle unchanged")
+	}
+}
+
+func TestPNGRouteWithoutPNGBadges(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 2, 2, 1)})
+	if w := get(t, newBadgeHandler("png"), "/badge.png?slot=1"); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := get(t, newBadgeHandler(""), "/badge.gif?slot=1&format=png"); w.Code != http.StatusOK {
+		t.Errorf("format=png on /badge.gif: status = %d, want %d from the fallback", w.Code, http.StatusOK)
+	}
+}
+
+func TestPNGRouteServesPNGBadges(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.png": testPNG(t, 2, 2)})
+	for slot := 1; slot <= 3; slot++ {
+		w := get(t, newBadgeHandler("png"), "/badge.png?slot="+strconv.Itoa(slot))
+		if w.Code != http.StatusOK {
+			t.Fatalf("slot %d: status = %d, want %d", slot, w.Code, http.StatusOK)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+			t.Errorf("slot %d: Content-Type = %q, want image/png", slot, ct)
+		}
+	}
+}
+
+func TestSlotsUpToBadgeCountAreDistinct(t *testing.T) {
+	for n := 1; n <= 8; n++ {
+		files := make([]string, n)
+		for i := range files {
+			files[i] = "badge" + strconv.Itoa(i) + ".gif"
+		}
+		s := badgeSnapshot{files: files}
+		for seed := int64(-50); seed < 50; seed++ {
+			seen := make(map[string]int)
+			for slot := 1; slot <= n; slot++ {
+				name, err := s.pick(s.candidates("", ""), "", seed, slot)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if previous, ok := seen[name]; ok {
+					t.Fatalf("%d badges, seed %d: slots %d and %d both got %q", n, seed, previous, slot, name)
+				}
+				seen[name] = slot
+			}
+			for slot := n + 1; slot <= 2*n; slot++ {
+				got, _ := s.pick(s.candidates("", ""), "", seed, slot)
+				want, _ := s.pick(s.candidates("", ""), "", seed, slot-n)
+				if got != want {
+					t.Fatalf("%d badges, seed %d: slot %d = %q, want it to wrap to slot %d's %q", n, seed, slot, got, slot-n, want)
+				}
+			}
+		}
+	}
+}
+
+func TestSlotsWithinFormatAreDistinct(t *testing.T) {
+	s := badgeSnapshot{files: []string{"a.gif", "b.png", "c.gif", "d.png", "e.png"}}
+	for seed := int64(0); seed < 100; seed++ {
+		seen := make(map[string]bool)
+		for slot := 1; slot <= 3; slot++ {
+			name, err := s.pick(s.candidates("", ""), "png", seed, slot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[name] {
+				t.Fatalf("seed %d: format=png repeated %q within 3 slots", seed, name)
+			}
+			seen[name] = true
+		}
+	}
+}
+
+func TestCheckTotalSlots(t *testing.T) {
+	for _, tc := range []struct {
+		slots   string
+		slot    int
+		wantErr bool
+	}{
+		{"", 9, false},
+		{"5", 1, false},
+		{"5", 5, false},
+		{"5", 6, true},
+		{"0", 1, true},
+		{"-2", 1, true},
+		{"many", 1, true},
+	} {
+		if err := checkTotalSlots(tc.slots, tc.slot, 3); (err != nil) != tc.wantErr {
+			t.Errorf("checkTotalSlots(%q, %d, 3) = %v, want error %v", tc.slots, tc.slot, err, tc.wantErr)
+		}
+	}
+}
+
+func TestBadgeHandlerTotalSlots(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 2, 2, 1)})
+	handler := newBadgeHandler("")
+	for target, want := range map[string]int{
+		"/badge.gif?slot=2&slots=4&seed=1": http.StatusOK,
+		"/badge.gif?slot=4&slots=4&seed=1": http.StatusOK,
+		"/badge.gif?slot=5&slots=4&seed=1": http.StatusBadRequest,
+		"/badge.gif?slot=1&slots=x&seed=1": http.StatusBadRequest,
+	} {
+		if w := get(t, handler, target); w.Code != want {
+			t.Errorf("%s: status = %d, want %d", target, w.Code, want)
+		}
+	}
+}
+
+func TestResolveInstanceSalt(t *testing.T) {
+	t.Setenv("INSTANCE_SALT", "")
+	if salt := resolveInstanceSalt(); salt != 0 {
+		t.Errorf("unset INSTANCE_SALT gave %d, want 0", salt)
+	}
+	t.Setenv("INSTANCE_SALT", "replica-a")
+	a := resolveInstanceSalt()
+	if again := resolveInstanceSalt(); again != a {
+		t.Errorf("INSTANCE_SALT=replica-a gave %d then %d, want it fixed across restarts", a, again)
+	}
+	t.Setenv("INSTANCE_SALT", "replica-b")
+	if b := resolveInstanceSalt(); b == a {
+		t.Error("different INSTANCE_SALT values gave the same salt")
+	}
+}
+
+func TestSessionPositionsAreNotSalted(t *testing.T) {
+	setForTest(t, &rotationMode, "session")
+	setForTest(t, &newStrategy, rotationModes["session"])
+	files := []string{"a.gif", "b.gif", "c.gif", "d.gif"}
+	s := badgeSnapshot{files: files}
+	for position := int64(0); position < 8; position++ {
+		setForTest(t, &instanceSalt, 0)
+		unsalted, err := s.pick(files, "", position, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		instanceSalt = 12345
+		if salted, _ := s.pick(files, "", position, 1); salted != unsalted {
+			t.Fatalf("session position %d: salt changed the badge from %q to %q", position, unsalted, salted)
+		}
+	}
+}
+
+func TestSelectionSurvivesRestarts(t *testing.T) {
+	t.Setenv("INSTANCE_SALT", "replica")
+	setForTest(t, &instanceSalt, resolveInstanceSalt())
+	useBadges(t, map[string][]byte{
+		"a.gif": testGIF(t, 2, 2, 1),
+		"b.gif": testGIF(t, 2, 2, 1),
+		"c.gif": testGIF(t, 2, 2, 1),
+		"d.gif": testGIF(t, 2, 2, 1),
+	})
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	mapping := func() []string {
+		seed := windowSeed(now)
+		s := snapshotBadges()
+		var got []string
+		for slot := 1; slot <= 6; slot++ {
+			name, err := s.pick(s.candidates("", ""), "", seed, slot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, name)
+		}
+		return got
+	}
+	want := mapping()
+	for restart := range 3 {
+		// A restart rediscovers the same files and re-reads the salt.
+		instanceSalt = resolveInstanceSalt()
+		resetDiscovery()
+		discoverBadges()
+		if got := mapping(); !slices.Equal(got, want) {
+			t.Fatalf("after restart %d slots map to %v, want %v", restart+1, got, want)
+		}
+	}
+}
+
+func TestFixedStrategy(t *testing.T) {
+	files := []string{"a.gif", "b.gif", "c.gif"}
+	for slot, want := range map[int]string{1: "a.gif", 2: "b.gif", 3: "c.gif", 4: "a.gif", 8: "b.gif"} {
+		for _, seed := range []int64{0, 1, -5, 1 << 40} {
+			got, err := fixedStrategy{}.Select(files, seed, slot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("seed %d slot %d = %q, want %q", seed, slot, got, want)
+			}
+		}
+	}
+	if _, err := (fixedStrategy{}).Select(nil, 0, 1); !errors.Is(err, errNoBadges) {
+		t.Errorf("empty list: error = %v, want errNoBadges", err)
+	}
+	if _, err := (fixedStrategy{}).Select(files, 0, 0); !errors.Is(err, errInvalidSlot) {
+		t.Errorf("slot 0: error = %v, want errInvalidSlot", err)
+	}
+}
+
+func TestFixedModeIgnoresWindow(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 2, 2, 1), "c.gif": testGIF(t, 2, 2, 1)})
+	setForTest(t, &rotationMode, "fixed")
+	setForTest(t, &newStrategy, rotationModes["fixed"])
+	s := snapshotBadges()
+	for seed := int64(0); seed < 20; seed++ {
+		for slot, want := range []string{"a.gif", "b.gif", "c.gif"} {
+			if got, _ := s.pick(s.candidates("", ""), "", seed, slot+1); got != want {
+				t.Fatalf("seed %d slot %d = %q, want %q", seed, slot+1, got, want)
+			}
+		}
+	}
+}
+
+func TestWindowModeShuffles(t *testing.T) {
+	files := make([]string, 8)
+	for i := range files {
+		files[i] = "badge" + strconv.Itoa(i) + ".gif"
+	}
+	s := badgeSnapshot{files: files}
+	shuffled := false
+	for seed := int64(0); seed < 10 && !shuffled; seed++ {
+		for slot := 1; slot <= len(files); slot++ {
+			if got, _ := s.pick(files, "", seed, slot); got != files[slot-1] {
+				shuffled = true
+			}
+		}
+	}
+	if !shuffled {
+		t.Error("the default mode served every seed in discovered order")
+	}
+}
+
+func TestRotationModesRegistry(t *testing.T) {
+	files := []string{"a.gif", "b.gif", "c.gif"}
+	for _, mode := range []string{"window", "daily", "fixed", "session"} {
+		build, ok := rotationModes[mode]
+		if !ok {
+			t.Errorf("ROTATION_MODE=%s is not registered", mode)
+			continue
+		}
+		for slot := 1; slot <= 4; slot++ {
+			name, err := build(badgeSnapshot{files: files}).Select(files, 9, slot)
+			if err != nil || !slices.Contains(files, name) {
+				t.Errorf("%s: slot %d = %q, %v, want one of %v", mode, slot, name, err, files)
+			}
+		}
+	}
+	for value, want := range map[string]string{"": "window", "fixed": "fixed", " daily ": "daily", "random": "window"} {
+		t.Setenv("ROTATION_MODE", value)
+		if got := resolveRotationMode(); got != want {
+			t.Errorf("ROTATION_MODE=%q gave %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestSequenceStrategy(t *testing.T) {
+	files := []string{"a.gif", "b.gif", "c.gif"}
+	for _, tc := range []struct {
+		seed int64
+		slot int
+		want string
+	}{
+		{0, 1, "a.gif"},
+		{0, 3, "c.gif"},
+		{1, 1, "b.gif"},
+		{2, 2, "a.gif"},
+		{-1, 1, "c.gif"},
+		{-4, 1, "c.gif"},
+		{0, 4, "a.gif"},
+	} {
+		if got, _ := (sequenceStrategy{}).Select(files, tc.seed, tc.slot); got != tc.want {
+			t.Errorf("seed %d slot %d = %q, want %q", tc.seed, tc.slot, got, tc.want)
+		}
+	}
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	w := weightedStrategy{weights: map[string]int{"a.gif": 3, "b.gif": 0}, next: fixedStrategy{}}
+	files := []string{"a.gif", "b.gif", "c.gif"}
+	var got []string
+	for slot := 1; slot <= 4; slot++ {
+		name, err := w.Select(files, 0, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, name)
+	}
+	if want := []string{"a.gif", "a.gif", "a.gif", "c.gif"}; !slices.Equal(got, want) {
+		t.Errorf("weighted slots = %v, want %v", got, want)
+	}
+}
+
+func TestFeaturedStrategy(t *testing.T) {
+	files := []string{"a.gif", "b.gif", "c.gif"}
+	f := featuredStrategy{featured: "b.gif", next: fixedStrategy{}}
+	var got []string
+	for slot := 1; slot <= 4; slot++ {
+		name, _ := f.Select(files, 0, slot)
+		got = append(got, name)
+	}
+	if want := []string{"b.gif", "a.gif", "c.gif", "a.gif"}; !slices.Equal(got, want) {
+		t.Errorf("featured slots = %v, want %v", got, want)
+	}
+	missing := featuredStrategy{featured: "gone.gif", next: fixedStrategy{}}
+	if name, _ := missing.Select(files, 0, 1); name != "a.gif" {
+		t.Errorf("with the featured badge missing slot 1 = %q, want a.gif", name)
+	}
+}
+
+func TestFilteredStrategy(t *testing.T) {
+	files := []string{"a.gif", "b.png", "c.gif", "d.png"}
+	f := filteredStrategy{keep: func(name string) bool { return badgeExt(name) == ".png" }, next: fixedStrategy{}}
+	for slot, want := range map[int]string{1: "b.png", 2: "d.png", 3: "b.png"} {
+		if got, _ := f.Select(files, 0, slot); got != want {
+			t.Errorf("slot %d = %q, want %q", slot, got, want)
+		}
+	}
+	none := filteredStrategy{keep: func(string) bool { return false }, next: fixedStrategy{}}
+	if _, err := none.Select(files, 0, 1); !errors.Is(err, errNoBadges) {
+		t.Errorf("nothing kept: error = %v, want errNoBadges", err)
+	}
+}
+
+func TestFormatFilterFollowsUnfilteredOrder(t *testing.T) {
+	files := []string{"a.gif", "b.png", "c.gif", "d.png", "e.png", "f.gif", "g.png"}
+	for _, featured := range []string{"", "b.png", "a.gif"} {
+		setForTest(t, &featuredBadge, featured)
+		s := badgeSnapshot{files: files}
+		for seed := int64(0); seed < 30; seed++ {
+			var pngs []string
+			for slot := 1; slot <= len(files); slot++ {
+				name, err := s.pick(files, "", seed, slot)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if badgeExt(name) == ".png" {
+					pngs = append(pngs, name)
+				}
+			}
+			for slot, want := range pngs {
+				got, err := s.pick(files, "png", seed, slot+1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Fatalf("featured %q seed %d: slot=%d&format=png = %q, want %q, the PNGs in unfiltered order being %v", featured, seed, slot+1, got, want, pngs)
+				}
+			}
+		}
+	}
+}
+
+func TestFormatFilterWithoutMatches(t *testing.T) {
+	files := []string{"a.gif", "b.gif"}
+	s := badgeSnapshot{files: files}
+	for slot := 1; slot <= 2; slot++ {
+		unfiltered, _ := s.pick(files, "", 5, slot)
+		if got, _ := s.pick(files, "png", 5, slot); got != unfiltered {
+			t.Errorf("slot %d: format=png with no PNGs = %q, want the unfiltered %q", slot, got, unfiltered)
+		}
+	}
+}
+
+func TestParseSlot(t *testing.T) {
+	for value, want := range map[string]int{"": 1, "1": 1, "7": 7, "0": 1, "-3": 1, "two": 1, "1.5": 1} {
+		if got := parseSlot(value); got != want {
+			t.Errorf("parseSlot(%q) = %d, want %d", value, got, want)
+		}
+	}
+}
+
+func TestStrictSlot(t *testing.T) {
+	useBadges(t, map[string][]byte{"a.gif": testGIF(t, 2, 2, 1), "b.gif": testGIF(t, 3, 3, 1), "c.gif": testGIF(t, 4, 4, 1)})
+	handler := newBadgeHandler("")
+	for _, tc := range []struct {
+		query           string
+		lenient, strict int
+	}{
+		{"slot=1", http.StatusOK, http.StatusOK},
+		{"slot=3", http.StatusOK, http.StatusOK},
+		{"", http.StatusOK, http.StatusBadRequest},
+		{"slot=0", http.StatusOK, http.StatusBadRequest},
+		{"slot=-1", http.StatusOK, http.StatusBadRequest},
+		{"slot=4", http.StatusOK, http.StatusBadRequest},
+		{"slot=x", http.StatusOK, http.StatusBadRequest},
+	} {
+		for _, strict := range []bool{false, true} {
+			setForTest(t, &strictSlot, strict)
+			want := tc.lenient
+			if strict {
+				want = tc.strict
+			}
+			if w := get(t, handler, "/badge.gif?seed=1&"+tc.query); w.Code != want {
+				t.Errorf("STRICT_SLOT=%v %q: status = %d, want %d", strict, tc.query, w.Code, want)
+			}
+		}
+	}
+
+	setForTest(t, &strictSlot, false)
+	for _, query := range []string{"", "slot=0", "slot=x"} {
+		want := get(t, handler, "/badge.gif?seed=1&slot=1").Body.String()
+		if got := get(t, handler, "/badge.gif?seed=1&"+query).Body.String(); got != want {
+			t.Errorf("lenient %q served a different badge than slot 1", query)
+		}
+	}
+}
+
+func TestKeySeed(t *testing.T) {
+	files := []string{"a.gif", "b.gif", "c.gif", "d.gif", "e.gif"}
+	s := badgeSnapshot{files: files}
+	pickFor := func(query url.Values) string {
+		t.Helper()
+		seed, err := resolveSeed(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, err := s.pick(files, "", seed, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	want := pickFor(url.Values{"key": {"octocat"}})
+	for _, mode := range []string{"window", "daily"} {
+		setForTest(t, &rotationMode, mode)
+		for range 3 {
+			if got := pickFor(url.Values{"key": {"octocat"}}); got != want {
+				t.Fatalf("%s mode: key=octocat gave %q then %q", mode, want, got)
+			}
+		}
+	}
+
+	counts := make(map[string]int)
+	for i := range 1000 {
+		counts[pickFor(url.Values{"key": {"user" + strconv.Itoa(i)}})]++
+	}
+	for _, name := range files {
+		if counts[name] < 120 || counts[name] > 280 {
+			t.Errorf("1000 keys gave %s %d times, want about 200: %v", name, counts[name], counts)
+		}
+	}
+
+	if _, err := resolveSeed(url.Values{"key": {"octocat"}, "seed": {"3"}}); err == nil {
+		t.Error("key and seed together were accepted")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+var contactSheet = template.Must(template.New("sheet").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Badge Rotator</title>
+<style>
+body { font-family: sans-serif; margin: 2rem; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(160px, 1fr)); gap: 1rem; }
+figure { margin: 0; text-align: center; }
+img { max-width: 150px; max-height: 150px; }
+figcaption { font-size: 0.8rem; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Badge Rotator</h1>
+<p>{{len .}} badges discovered. Embed <code>/badge.gif?slot=1</code>, <code>/badge.gif?slot=2</code> and so on.</p>
+<div class="grid">
+{{range .}}<figure>
+<img src="{{.Src}}" alt="{{.Name}}" loading="lazy">
+<figcaption>{{.Name}}</figcaption>
+</figure>
+{{end}}</div>
+</body>
+</html>
+`))
+
+type sheetEntry struct {
+	Name string
+	Src  string
+}
+
+// contactSheetHandler renders every discovered badge as a thumbnail grid,
+// each thumbnail served by name from /badge/{filename}.
+func contactSheetHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot := snapshotBadges()
+	entries := make([]sheetEntry, len(snapshot.files))
+	for i, name := range snapshot.files {
+		entries[i] = sheetEntry{Name: name, Src: "/badge/" + (&url.URL{Path: name}).EscapedPath()}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := contactSheet.Execute(w, entries); err != nil {
+		requestLog(r).Error("could not render contact sheet", "error", err)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStripCount = 3
+	maxStripCount     = 10
+	// maxStripDuration and maxStripFrames bound the composited animation, in
+	// 100ths of a second and frames, to keep strip encoding cheap.
+	maxStripDuration = 1000
+	maxStripFrames   = 100
+	// minGIFDelay is the frame delay browsers use in place of 0 or 1.
+	minGIFDelay = 10
+)
+
+// stripPalette is palette.Plan9 with its last entry replaced by transparent
+// so transparent badge areas stay transparent in the strip.
+var stripPalette = func() color.Palette {
+	p := make(color.Palette, len(palette.Plan9))
+	copy(p, palette.Plan9)
+	p[len(p)-1] = color.Transparent
+	return p
+}()
+
+// animation is a badge decoded into fully composited frames.
+type animation struct {
+	frames []*image.RGBA
+	delays []int
+}
+
+func (a animation) duration() int {
+	total := 0
+	for _, delay := range a.delays {
+		total += delay
+	}
+	return total
+}
+
+// frameAt returns the frame showing t 100ths of a second in, looping.
+func (a animation) frameAt(t int) *image.RGBA {
+	if len(a.frames) == 1 {
+		return a.frames[0]
+	}
+	t %= a.duration()
+	for i, delay := range a.delays {
+		if t < delay {
+			return a.frames[i]
+		}
+		t -= delay
+	}
+	return a.frames[len(a.frames)-1]
+}
+
+// stripDecodable reports whether the strip can decode badges of contentType.
+// Only GIF, PNG and JPEG have decoders registered, so WebP and AVIF badges
+// are left out of strips like SVG ones.
+func stripDecodable(contentType string) bool {
+	switch contentType {
+	case "image/gif", "image/png", "image/jpeg":
+		return true
+	}
+	return false
+}
+
+// decodeAnimation decodes a GIF into composited frames, honouring each
+// frame's disposal method, or any other raster badge into a single frame.
+func decodeAnimation(data []byte, contentType string) (animation, error) {
+	if contentType != "image/gif" {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return animation{}, err
+		}
+		frame := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(frame, frame.Bounds(), img, img.Bounds().Min, draw.Src)
+		return animation{frames: []*image.RGBA{frame}, delays: []int{minGIFDelay}}, nil
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return animation{}, err
+	}
+	var a animation
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		a.frames = append(a.frames, cloneRGBA(canvas))
+		a.delays = append(a.delays, max(g.Delay[i], minGIFDelay))
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	if len(a.frames) == 0 {
+		return animation{}, errors.New("gif has no frames")
+	}
+	return a, nil
+}
+
+func cloneRGBA(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+// composeStrip lays animations out left to right, top-aligned, as one
+// animated GIF. Shorter animations loop until the longest one finishes, and
+// static badges hold their single frame throughout.
+func composeStrip(animations []animation) ([]byte, error) {
+	width, height, total := 0, 0, 0
+	cuts := map[int]bool{0: true}
+	for _, a := range animations {
+		b := a.frames[0].Bounds()
+		width += b.Dx()
+		height = max(height, b.Dy())
+		if len(a.frames) > 1 {
+			total = max(total, a.duration())
+		}
+	}
+	total = min(total, maxStripDuration)
+	for _, a := range animations {
+		if len(a.frames) == 1 {
+			continue
+		}
+		for start := 0; start < total; {
+			for _, delay := range a.delays {
+				start += delay
+				if start < total {
+					cuts[start] = true
+				}
+			}
+		}
+	}
+
+	starts := make([]int, 0, len(cuts))
+	for start := range cuts {
+		starts = append(starts, start)
+	}
+	slices.Sort(starts)
+	if len(starts) > maxStripFrames {
+		starts = starts[:maxStripFrames]
+		total = starts[len(starts)-1] + minGIFDelay
+	}
+
+	// After the first frame only the animated badges' columns change, so
+	// later frames cover just that area and leave the rest in place.
+	bounds := image.Rect(0, 0, width, height)
+	var animatedBounds image.Rectangle
+	x := 0
+	for _, a := range animations {
+		b := a.frames[0].Bounds().Add(image.Pt(x, 0))
+		if len(a.frames) > 1 {
+			animatedBounds = animatedBounds.Union(b)
+		}
+		x += b.Dx()
+	}
+
+	out := &gif.GIF{Config: image.Config{Width: width, Height: height, ColorModel: stripPalette}}
+	canvas := image.NewRGBA(bounds)
+	for i, start := range starts {
+		x := 0
+		for _, a := range animations {
+			frame := a.frameAt(start)
+			draw.Draw(canvas, frame.Bounds().Add(image.Pt(x, 0)), frame, image.Point{}, draw.Src)
+			x += frame.Bounds().Dx()
+		}
+		frameBounds := bounds
+		if i > 0 {
+			frameBounds = animatedBounds
+		}
+		paletted := image.NewPaletted(frameBounds, stripPalette)
+		draw.FloydSteinberg.Draw(paletted, frameBounds, canvas, frameBounds.Min)
+
+		delay := minGIFDelay
+		if i+1 < len(starts) {
+			delay = starts[i+1] - start
+		} else if total > start {
+			delay = total - start
+		}
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, delay)
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stripHandler serves /badges-strip.gif, compositing the badges of slots
+// 1..count for the current rotation window side by side in one image. It
+// skips repeats so every badge in the strip is distinct. SVG, WebP and AVIF
+// badges are left out, since they can't be decoded for compositing.
+func stripHandler(w http.ResponseWriter, r *http.Request) {
+	count := defaultStripCount
+	if countStr := r.URL.Query().Get("count"); countStr != "" {
+		parsed, err := strconv.Atoi(countStr)
+		if err != nil || parsed < 1 || parsed > maxStripCount {
+			writeError(w, r, fmt.Sprintf("count must be between 1 and %d", maxStripCount), http.StatusBadRequest)
+			return
+		}
+		count = parsed
+	}
+	baseSeed, err := resolveSeed(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	snapshot := snapshotBadges()
+	candidates := slices.DeleteFunc(slices.Clone(snapshot.candidates(r.URL.Query().Get("group"), "")), func(name string) bool {
+		return !stripDecodable(contentTypeFor(name))
+	})
+	if len(candidates) == 0 {
+		badgeErrorsTotal.inc("no_badges")
+		writeError(w, r, "No badges available", http.StatusNotFound)
+		return
+	}
+
+	var selected []string
+	limit := len(applyWeights(candidates, snapshot.weights)) + 1
+	for slot := 1; len(selected) < count && slot <= limit; slot++ {
+		name, err := snapshot.pick(candidates, "", baseSeed, slot)
+		if err != nil {
+			requestLog(r).Error("could not select badge for strip", "slot", slot, "seed", baseSeed, "error", err)
+			writeError(w, r, "Error selecting badge", http.StatusInternalServerError)
+			return
+		}
+		if !slices.Contains(selected, name) {
+			selected = append(selected, name)
+		}
+	}
+
+	var newest time.Time
+	badges := make([]locatedBadge, len(selected))
+	for i, name := range selected {
+		if !checkBadgeFilename(w, r, name) {
+			return
+		}
+		badges[i], err = locateBadge(name)
+		if err != nil {
+			requestLog(r).Error("could not read badge", "filename", name, "error", err)
+			badgeErrorsTotal.inc("not_found")
+			writeError(w, r, "Badge not found", http.StatusNotFound)
+			return
+		}
+		if badges[i].modTime.After(newest) {
+			newest = badges[i].modTime
+		}
+	}
+
+	build := func() ([]byte, error) {
+		animations := make([]animation, 0, len(selected))
+		for _, badge := range badges {
+			data, err := readBadge(badge.name, badge.path, badge.modTime)
+			if err != nil {
+				return nil, err
+			}
+			contentType := detectContentType(badge.name, data)
+			if !stripDecodable(contentType) {
+				// Mislabeled, not broken: it still serves fine on its own.
+				requestLog(r).Warn("leaving badge out of strip, its content can't be decoded", "filename", badge.name, "contentType", contentType)
+				continue
+			}
+			a, err := decodeAnimation(data, contentType)
+			if err != nil {
+				markCorrupt(badge.name, err)
+				return nil, fmt.Errorf("decoding %s: %w", badge.name, err)
+			}
+			animations = append(animations, a)
+		}
+		if len(animations) == 0 {
+			return nil, errors.New("none of the selected badges can be decoded")
+		}
+		return composeStrip(animations)
+	}
+	var data []byte
+	if badgeBytes == nil {
+		data, err = build()
+	} else {
+		// Strips aren't tied to one badge file, so they are keyed by their
+		// contents and dropped by the next discovery's prune.
+		data, err = badgeBytes.load("strip#"+strings.Join(selected, "|"), "", newest, build)
+	}
+	if err != nil {
+		requestLog(r).Error("could not compose badge strip", "badges", selected, "error", err)
+		badgeErrorsTotal.inc("strip")
+		writeError(w, r, "Error composing badge strip", http.StatusInternalServerError)
+		return
+	}
+
+	noteServedBadge(r, strings.Join(selected, ","))
+	setRotationCacheHeaders(w)
+	etag := badgeETag(strings.Join(selected, "|"), "strip", baseSeed)
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", servedContentType("badges-strip.gif", "image/gif"))
+	http.ServeContent(w, r, "badges-strip.gif", newest, bytes.NewReader(data))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// testWebP is the start of a WebP file, enough to pass its signature check
+// and sniffing but not to decode.
+var testWebP = []byte("RIFF\x1a\x00\x00\x00WEBPVP8 \x0e\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+
+func TestStripSkipsUndecodableBadges(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files map[string][]byte
+	}{
+		{"webp extension", map[string][]byte{
+			"a.gif":  testGIF(t, 4, 4, 2),
+			"b.png":  testPNG(t, 4, 4),
+			"c.webp": testWebP,
+		}},
+		{"webp named png", map[string][]byte{
+			"a.gif": testGIF(t, 4, 4, 2),
+			"b.png": testPNG(t, 4, 4),
+			"c.png": testWebP,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useBadges(t, tc.files)
+			w := get(t, stripHandler, "/badges-strip.gif?count=3&seed=1")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			g := decodeGIF(t, w.Body.Bytes())
+			if g.Config.Width != 8 {
+				t.Errorf("strip width = %d, want 8 from the two decodable badges", g.Config.Width)
+			}
+			if files := currentBadgeFiles(); len(files) != 3 {
+				t.Errorf("badges after strip = %v, want all three still in rotation", files)
+			}
+		})
+	}
+}
+
+func TestStripDropsCorruptBadges(t *testing.T) {
+	useBadges(t, map[string][]byte{
+		"a.gif":      testGIF(t, 4, 4, 2),
+		"broken.png": append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...),
+	})
+	if w := get(t, stripHandler, "/badges-strip.gif?count=2&seed=1"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if files := currentBadgeFiles(); slices.Contains(files, "broken.png") {
+		t.Errorf("badges = %v, want broken.png dropped from rotation", files)
+	}
+}
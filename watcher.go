@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long the watcher waits after the last filesystem event
+// before rediscovering, so a batch copy triggers a single rescan.
+const watchDebounce = 500 * time.Millisecond
+
+// startBadgeWatcher watches badgesDir and its subdirectories and reruns
+// discoverBadges whenever badges are created, removed or renamed. The
+// watching goroutine exits once the returned watcher is closed.
+func startBadgeWatcher() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(badgesDir, func(path string, d fs.DirEntry, errWalk error) error {
+		if errWalk != nil {
+			return errWalk
+		}
+		if d.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		var debounce *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					if debounce != nil {
+						debounce.Stop()
+					}
+					return
+				}
+				if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Remove) && !event.Has(fsnotify.Rename) {
+					continue
+				}
+				if event.Has(fsnotify.Create) {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						if err := watcher.Add(event.Name); err != nil {
+							slog.Error("could not watch new directory", "dir", event.Name, "error", err)
+						}
+					}
+				}
+				if debounce == nil {
+					debounce = time.AfterFunc(watchDebounce, discoverBadges)
+				} else {
+					debounce.Reset(watchDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("badge watcher error", "error", err)
+			}
+		}
+	}()
+	return watcher, nil
+}